@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// accessLog writes one line per request in Apache's Combined Log Format to
+// ACCESS_LOG, apart from the application log. Each line goes out in a single
+// write to a file opened O_APPEND, so lines never interleave, not even with
+// another process appending to the same file. On SIGHUP the file is reopened,
+// so logrotate can move it away and signal the proxy.
+type accessLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// access is nil when ACCESS_LOG is unset
+var access *accessLog
+
+func openAccessLog(path string) (*accessLog, error) {
+	a := &accessLog{path: path}
+	if err := a.reopen(); err != nil {
+		return nil, err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := a.reopen(); err != nil {
+				logger.Errorf("Reopening ACCESS_LOG: %v", err)
+				continue
+			}
+			logger.Infof("Reopened ACCESS_LOG %s", a.path)
+		}
+	}()
+	return a, nil
+}
+
+// reopen switches to a fresh handle on the log's path, keeping the old one
+// if the file can't be opened
+func (a *accessLog) reopen() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = f
+	return nil
+}
+
+// record logs a finished request. The key label stands in for the remote
+// user, and the duration in seconds follows the standard fields, as with
+// nginx's $request_time.
+func (a *accessLog) record(r *http.Request, rec *statusRecorder, start time.Time) {
+	host := "-" // Unix socket clients have no address
+	if ip := clientIP(r); ip != nil {
+		host = ip.String()
+	}
+	user := "-"
+	if key := requestKey(r); key != "" {
+		user = keyLabel(key)
+	}
+	size := "-"
+	if rec.bytes > 0 {
+		size = strconv.FormatInt(rec.bytes, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s %.3f\n",
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto),
+		rec.status, size, quoteOrDash(r.Referer()), quoteOrDash(r.UserAgent()),
+		time.Since(start).Seconds())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.WriteString(line); err != nil {
+		logger.Errorf("Writing ACCESS_LOG: %v", err)
+	}
+}
+
+// quoteOrDash quotes a header value for the log, escaping anything that
+// could break the line, or gives "-" for an empty one
+func quoteOrDash(v string) string {
+	if v == "" {
+		return `"-"`
+	}
+	return strconv.Quote(v)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// adminKey (ADMIN_KEY) authenticates POST /admin/reload, which is off
+	// without one. It is separate from PROXY_API_KEY so clients can't reload.
+	adminKey string
+
+	// configFile (CONFIG_FILE) holds KEY=VALUE settings that override the
+	// environment, read at startup and again on every reload
+	configFile string
+
+	// baseEnv is the environment before CONFIG_FILE was applied, and
+	// fileSettings what CONFIG_FILE set, so a setting deleted from the file
+	// goes back to its environment value
+	baseEnv      map[string]string
+	fileSettings map[string]string
+
+	// reloading lets one reload run at a time
+	reloading sync.Mutex
+)
+
+// reloadMu guards the settings a reload replaces: modelAliases,
+// allowedModels, proxySystemPrompt, allowNets, denyNets and the rate
+// limiters. Requests
+// read them under RLock; before serving starts, main sets them freely.
+var reloadMu sync.RWMutex
+
+// liveSettings can be changed by a reload. Any other setting that changes in
+// CONFIG_FILE is reported as needing a restart, and left as it was.
+var liveSettings = map[string]bool{
+	"MODEL_ALIASES":            true,
+	"ALLOWED_MODELS":           true,
+	"PROXY_SYSTEM_PROMPT":      true,
+	"PROXY_SYSTEM_PROMPT_FILE": true,
+	"SYSTEM_PROMPT_DIR":        true,
+	"ALLOW_CIDRS":              true,
+	"DENY_CIDRS":               true,
+	"RATE_LIMIT_RPM":           true,
+	"USER_RATE_LIMIT_RPM":      true,
+	"IP_RATE_LIMIT_RPM":        true,
+}
+
+// readConfigFile parses CONFIG_FILE: one KEY=VALUE per line, like an env
+// file. Blank lines and lines starting with # are skipped, and a value wrapped
+// in matching quotes loses them. Nothing is expanded.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		settings[key] = value
+	}
+	return settings, scanner.Err()
+}
+
+// applyConfigFile reads CONFIG_FILE into the environment, before any other
+// setting is read
+func applyConfigFile(path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	baseEnv = map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			baseEnv[k] = v
+		}
+	}
+	for k, v := range settings {
+		os.Setenv(k, v)
+	}
+	configFile, fileSettings = path, settings
+	return nil
+}
+
+// liveConfig is what a reload puts in place
+type liveConfig struct {
+	aliases      map[string]string
+	allowed      map[string]bool
+	systemPrompt string
+	promptDir    string
+	modelPrompts map[string]string
+	allow, deny  []*net.IPNet
+	rpm          [3]int // RATE_LIMIT_RPM, USER_RATE_LIMIT_RPM, IP_RATE_LIMIT_RPM
+}
+
+// readLiveConfig parses the live settings from the environment, reading the
+// prompt files afresh. Unlike startup, a bad value is an error, not fatal.
+func readLiveConfig() (liveConfig, error) {
+	var c liveConfig
+	var err error
+	if c.aliases, err = parseModelAliases(os.Getenv("MODEL_ALIASES")); err != nil {
+		return c, fmt.Errorf("Invalid MODEL_ALIASES: %v", err)
+	}
+	if c.allowed, err = parseAllowedModels(os.Getenv("ALLOWED_MODELS")); err != nil {
+		return c, fmt.Errorf("Invalid ALLOWED_MODELS: %v", err)
+	}
+	if err = checkAllowedModels(c.allowed); err != nil {
+		return c, err
+	}
+	if c.systemPrompt, err = loadProxySystemPrompt(); err != nil {
+		return c, err
+	}
+	if c.promptDir = os.Getenv("SYSTEM_PROMPT_DIR"); c.promptDir != "" {
+		if c.modelPrompts, err = loadModelPrompts(c.promptDir); err != nil {
+			return c, fmt.Errorf("Invalid SYSTEM_PROMPT_DIR: %v", err)
+		}
+	}
+	if c.allow, err = parseCIDRs(os.Getenv("ALLOW_CIDRS")); err != nil {
+		return c, fmt.Errorf("Invalid ALLOW_CIDRS: %v", err)
+	}
+	if c.deny, err = parseCIDRs(os.Getenv("DENY_CIDRS")); err != nil {
+		return c, fmt.Errorf("Invalid DENY_CIDRS: %v", err)
+	}
+	for i, name := range []string{"RATE_LIMIT_RPM", "USER_RATE_LIMIT_RPM", "IP_RATE_LIMIT_RPM"} {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			if c.rpm[i], err = strconv.Atoi(v); err != nil {
+				return c, fmt.Errorf("Invalid %s %q: %v", name, v, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// apply puts c in place. A rate limiter whose limit is unchanged keeps its
+// buckets; one whose limit changed starts over with full ones.
+func (c liveConfig) apply() {
+	resize := func(l *rateLimiter, rpm int) *rateLimiter {
+		switch {
+		case rpm <= 0:
+			return nil
+		case l != nil && l.rpm == rpm:
+			return l
+		}
+		return newRateLimiter(rpm)
+	}
+	reloadMu.Lock()
+	modelAliases = c.aliases
+	allowedModels = c.allowed
+	proxySystemPrompt = c.systemPrompt
+	allowNets, denyNets = c.allow, c.deny
+	limiter = resize(limiter, c.rpm[0])
+	userLimiter = resize(userLimiter, c.rpm[1])
+	ipLimiter = resize(ipLimiter, c.rpm[2])
+	reloadMu.Unlock()
+	setModelPrompts(c.promptDir, c.modelPrompts)
+}
+
+// reloadConfig re-reads CONFIG_FILE and the prompt files. Live settings that
+// changed take effect at once and are returned in reloaded; others that
+// changed are returned in restart. If any new value is invalid, nothing
+// changes.
+func reloadConfig() (reloaded, restart []string, err error) {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	previous := map[string]*string{} // what to restore if the new values don't parse
+	if configFile != "" {
+		var settings map[string]string
+		if settings, err = readConfigFile(configFile); err != nil {
+			return nil, nil, fmt.Errorf("Reading CONFIG_FILE: %v", err)
+		}
+		want := map[string]*string{}
+		for k := range fileSettings {
+			if v, ok := baseEnv[k]; ok {
+				want[k] = &v
+			} else {
+				want[k] = nil
+			}
+		}
+		for k, v := range settings {
+			v := v
+			want[k] = &v
+		}
+		for k, v := range want {
+			current, set := os.LookupEnv(k)
+			if (v == nil && !set) || (v != nil && set && *v == current) {
+				continue
+			}
+			if !liveSettings[k] {
+				restart = append(restart, k)
+				continue
+			}
+			if set {
+				previous[k] = &current
+			} else {
+				previous[k] = nil
+			}
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+			reloaded = append(reloaded, k)
+		}
+		defer func() {
+			if err == nil {
+				// Settings needing a restart stay as they were, so they are
+				// reported again until it happens
+				for _, k := range restart {
+					if v, ok := fileSettings[k]; ok {
+						settings[k] = v
+					} else {
+						delete(settings, k)
+					}
+				}
+				fileSettings = settings
+			}
+		}()
+	}
+
+	c, err := readLiveConfig()
+	if err != nil {
+		for k, v := range previous {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+		return nil, nil, err
+	}
+	c.apply()
+	sort.Strings(reloaded)
+	sort.Strings(restart)
+	return reloaded, restart, nil
+}
+
+// handleReload serves POST /admin/reload. The reply lists the settings that
+// changed, and those that changed but need a restart to take effect.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if adminKey == "" {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "", "Set ADMIN_KEY to enable /admin/reload")
+		return
+	}
+	if !adminKeyMatches(r) {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "", "Invalid admin key")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log := loggerFrom(r.Context())
+	reloaded, restart, err := reloadConfig()
+	if err != nil {
+		log.Errorf("Reload failed, nothing changed: %v", err)
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Reloaded configuration, changing: %s", orNone(reloaded))
+	if len(restart) > 0 {
+		log.Warnf("Changed settings that need a restart to apply: %s", strings.Join(restart, ", "))
+	}
+	if reloaded == nil {
+		reloaded = []string{}
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	json.NewEncoder(w).Encode(map[string][]string{
+		"reloaded":         reloaded,
+		"restart_required": restart,
+	})
+}
+
+func orNone(names []string) string {
+	if len(names) == 0 {
+		return "nothing"
+	}
+	return strings.Join(names, ", ")
+}
+
+// adminKeyMatches checks the request's key against ADMIN_KEY, in either
+// header an API key may come in, in constant time
+func adminKeyMatches(r *http.Request) bool {
+	presented := strings.TrimSpace(r.Header.Get("X-Api-Key"))
+	if token := bearerToken(r); token != "" {
+		presented = token
+	}
+	return presented != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(adminKey)) == 1
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestReloadAllowedModels changes ALLOWED_MODELS in CONFIG_FILE and checks a
+// reload applies it at once, and that one leaving out CLAUDE_MODEL is refused
+// without changing anything
+func TestReloadAllowedModels(t *testing.T) {
+	setupProxy(t)
+	t.Setenv("ALLOWED_MODELS", "")
+	path := filepath.Join(t.TempDir(), "proxy.env")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("")
+	if err := applyConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { configFile, baseEnv, fileSettings = "", nil, nil })
+	opus := `{"model": "opus", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	write("ALLOWED_MODELS=sonnet,haiku\n")
+	reloaded, restart, err := reloadConfig()
+	if err != nil || !slices.Contains(reloaded, "ALLOWED_MODELS") || len(restart) > 0 {
+		t.Fatalf("reload: %v, reloaded %v, restart %v", err, reloaded, restart)
+	}
+	if w := postJSON(handleChat, "/v1/chat/completions", opus); w.Code != http.StatusForbidden {
+		t.Errorf("opus after the reload: %d %s, want 403", w.Code, w.Body)
+	}
+
+	write("ALLOWED_MODELS=opus\n")
+	if _, _, err := reloadConfig(); err == nil {
+		t.Errorf("reload leaving out CLAUDE_MODEL sonnet succeeded")
+	}
+	if w := postJSON(handleChat, "/v1/chat/completions", opus); w.Code != http.StatusForbidden {
+		t.Errorf("opus after a refused reload: %d %s, want still 403", w.Code, w.Body)
+	}
+
+	write("")
+	if _, _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if w := postJSON(handleChat, "/v1/chat/completions", opus); w.Code != http.StatusOK {
+		t.Errorf("opus once ALLOWED_MODELS is gone: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Anthropic Messages API request/response structures, so clients built on
+// Anthropic's own SDK can point at the proxy via /v1/messages
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        MessageContent     `json:"system"`
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     *int               `json:"max_tokens,omitempty"`
+	Stream        bool               `json:"stream"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences StopList           `json:"stop_sequences,omitempty"`
+	Metadata      struct {
+		UserID string `json:"user_id"` // the end user, like OpenAI's user field
+	} `json:"metadata"`
+}
+
+type AnthropicMessage struct {
+	Role    string         `json:"role"`
+	Content MessageContent `json:"content"`
+}
+
+type AnthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []AnthropicBlock `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        AnthropicUsage   `json:"usage"`
+}
+
+type AnthropicBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// AnthropicUsage counts input the way Anthropic does: input_tokens leaves
+// out what was written to or read from the prompt cache
+type AnthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// toChatRequest converts the Anthropic request into the proxy's internal
+// (OpenAI-shaped) request so both APIs share one CLI pipeline
+func (a AnthropicRequest) toChatRequest() ChatRequest {
+	req := ChatRequest{
+		Model:       a.Model,
+		Stream:      a.Stream,
+		Temperature: a.Temperature,
+		TopP:        a.TopP,
+		MaxTokens:   a.MaxTokens,
+		Stop:        a.StopSequences,
+		User:        a.Metadata.UserID,
+	}
+	if a.System.Text != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: a.System})
+	}
+	for _, msg := range a.Messages {
+		req.Messages = append(req.Messages, Message{Role: msg.Role, Content: msg.Content})
+	}
+	return req
+}
+
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authorized(r) {
+		sendAnthropicError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		sendAnthropicError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, status, err := readBody(w, r)
+	if err != nil {
+		sendAnthropicError(w, err.Error(), status)
+		return
+	}
+
+	var areq AnthropicRequest
+	if err := decodeRequest(body, &areq); err != nil {
+		sendAnthropicError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reqLog := loggerFrom(r.Context())
+	reqLog.Debugf("=== INCOMING MESSAGES REQUEST ===")
+	reqLog.Debugf("Model requested: %s, stream: %v, messages: %d", areq.Model, areq.Stream, len(areq.Messages))
+
+	req := areq.toChatRequest()
+	req.useModelHeader(r.Header.Get("X-Claude-Model"))
+	if !allowUser(w, r, req.User) {
+		return
+	}
+	run, cleanup, err := prepareRun(r.Context(), req)
+	defer cleanup()
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, errModelNotAllowed):
+			status = http.StatusForbidden
+		case errors.Is(err, errHookFailed):
+			status = http.StatusBadGateway
+		}
+		sendAnthropicError(w, err.Error(), status)
+		return
+	}
+
+	if isDryRun(r) {
+		sendDryRun(w, run, areq.Stream)
+		return
+	}
+	if err := run.useWorkdir(r.Header.Get("X-Claude-Workdir")); err != nil {
+		sendAnthropicError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	run.useConversation(r.Header.Get("X-Conversation-Id"))
+	run.useCache(r.Header.Get("X-Proxy-Cache"))
+	run.debugStderr = debugStream(r)
+	run.showTiming = showTiming(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if areq.Stream {
+		handleAnthropicStreaming(ctx, w, run)
+	} else {
+		handleAnthropicNonStreaming(ctx, w, run)
+	}
+}
+
+func handleAnthropicNonStreaming(ctx context.Context, w http.ResponseWriter, run *claudeRun) {
+	result, err := runClaude(ctx, run)
+	if clientGone(ctx, run) {
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		run.log.Errorf("Claude CLI timed out after %v", requestTimeout)
+		sendAnthropicError(w, fmt.Sprintf("Claude CLI timed out after %v", requestTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errBusy) {
+		sendBusy(w, err, sendAnthropicError)
+		return
+	}
+	if errors.Is(err, errCLIMissing) {
+		sendCLIMissing(w, sendAnthropicError)
+		return
+	}
+	if err != nil {
+		sendRunFailure(w, err, sendAnthropicError)
+		return
+	}
+
+	stopReason := result.StopReason
+	var stopSequence *string
+	if result.StopSequence != "" {
+		stopSequence = &result.StopSequence
+	}
+	run.setResultHeaders(w)
+	resp := AnthropicResponse{
+		ID:           fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        run.Model,
+		Content:      []AnthropicBlock{{Type: "text", Text: result.Text}},
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+		Usage:        anthropicUsage(w, run, result),
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleAnthropicStreaming(ctx context.Context, w http.ResponseWriter, run *claudeRun) {
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Trailer", "X-Usage-Source, X-Model-Used, X-Time-To-First-Token-Ms, X-Proxy-Timing")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// message_start is held back until the CLI is actually running, so a full
+	// queue can still be reported as a plain 429
+	started, startedBlock := false, false
+	start := func() {
+		if started {
+			return
+		}
+		// Real usage only arrives with the CLI's final result
+		var inputTokens int
+		if usageMode != "off" {
+			inputTokens = countTokens(run.SystemPrompt) + countTokens(run.UserPrompt)
+		}
+		sendSSEEvent(w, flusher, "message_start", map[string]interface{}{
+			"type": "message_start",
+			"message": AnthropicResponse{
+				ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+				Type:    "message",
+				Role:    "assistant",
+				Model:   run.Model,
+				Content: []AnthropicBlock{},
+				Usage:   AnthropicUsage{InputTokens: inputTokens},
+			},
+		})
+		started = true
+	}
+
+	var mu sync.Mutex
+	pings := newPinger(w, flusher, &mu)
+	run.onStart = pings.start
+	if run.debugStderr {
+		run.onStderr = pings.stderr
+	}
+	result, err := streamClaude(ctx, run, func(text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		start()
+		if !startedBlock {
+			sendSSEEvent(w, flusher, "content_block_start", map[string]interface{}{
+				"type":          "content_block_start",
+				"index":         0,
+				"content_block": AnthropicBlock{Type: "text"},
+			})
+			startedBlock = true
+		}
+		sendSSEEvent(w, flusher, "content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": text},
+		})
+	}, nil)
+	pinged := pings.stop()
+	if clientGone(ctx, run) {
+		return
+	}
+	if errors.Is(err, errBusy) {
+		w.Header().Set("Content-Type", "application/json")
+		sendBusy(w, err, sendAnthropicError)
+		return
+	}
+	if errors.Is(err, errCLIMissing) {
+		w.Header().Set("Content-Type", "application/json")
+		sendCLIMissing(w, sendAnthropicError)
+		return
+	}
+	if err != nil {
+		sendAnthropicSSEError(w, flusher, "Failed to start Claude CLI")
+		return
+	}
+	// Partial text ends normally, with stop_reason "max_tokens"
+	if ctx.Err() == context.DeadlineExceeded && !result.TimedOut {
+		run.log.Errorf("Streaming request timed out after %v", requestTimeout)
+		sendAnthropicSSEError(w, flusher, fmt.Sprintf("Claude CLI timed out after %v", requestTimeout))
+		return
+	}
+	if result.Err != nil {
+		if !started && !pinged {
+			w.Header().Set("Content-Type", "application/json")
+			sendRunFailure(w, result.Err, sendAnthropicError)
+			return
+		}
+		msg, _ := runFailure(result.Err)
+		sendAnthropicSSEError(w, flusher, msg)
+		return
+	}
+
+	start()
+	if startedBlock {
+		sendSSEEvent(w, flusher, "content_block_stop", map[string]interface{}{
+			"type":  "content_block_stop",
+			"index": 0,
+		})
+	}
+	run.setResultHeaders(w)
+	usage := anthropicUsage(w, run, result)
+	var stopSequence interface{}
+	if result.StopSequence != "" {
+		stopSequence = result.StopSequence
+	}
+	sendSSEEvent(w, flusher, "message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": result.StopReason, "stop_sequence": stopSequence},
+		"usage": usage,
+	})
+	sendSSEEvent(w, flusher, "message_stop", map[string]string{"type": "message_stop"})
+}
+
+// sendSSEEvent writes a named SSE event, as used by Anthropic's streaming API
+func sendSSEEvent(w http.ResponseWriter, flusher http.Flusher, event string, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	flusher.Flush()
+}
+
+func sendAnthropicSSEError(w http.ResponseWriter, flusher http.Flusher, message string) {
+	sendSSEEvent(w, flusher, "error", map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": "api_error", "message": message},
+	})
+}
+
+// sendAnthropicError writes an error in Anthropic's shape, which differs from
+// OpenAI's by a top-level "type" and its own set of error types
+func sendAnthropicError(w http.ResponseWriter, message string, status int) {
+	errType := "api_error"
+	switch status {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType:
+		errType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errType = "authentication_error"
+	case http.StatusRequestEntityTooLarge:
+		errType = "request_too_large"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
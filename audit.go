@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// auditRecord is one CLI run in AUDIT_LOG: everything the model was told and
+// everything it answered, in full
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Started      time.Time `json:"started"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	Client       string    `json:"client,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Model        string    `json:"model"`
+	Stream       bool      `json:"stream"`
+	SystemPrompt string    `json:"system_prompt"`
+	UserPrompt   string    `json:"user_prompt"`
+	Response     string    `json:"response"`
+	StopReason   string    `json:"stop_reason,omitempty"`
+	Cache        string    `json:"cache,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// auditBuffer is how many records may wait for the sink before new ones are
+// dropped, so a slow disk or webhook never holds up a request
+const auditBuffer = 1024
+
+// auditLog sends records to AUDIT_LOG, a file or an http(s) webhook, from a
+// goroutine of its own. Files get one JSON line per record, appended in a
+// single write, and are reopened on SIGHUP like ACCESS_LOG. A webhook gets
+// each record POSTed as JSON.
+type auditLog struct {
+	records chan auditRecord
+	done    chan struct{}
+	url     string // the webhook, if it isn't a file
+	client  *http.Client
+
+	mu   sync.Mutex
+	path string
+	file *os.File
+
+	dropped int64 // records lost to a full buffer, only touched by record
+}
+
+// audit is nil when AUDIT_LOG is unset
+var audit *auditLog
+
+func openAuditLog(target string) (*auditLog, error) {
+	a := &auditLog{records: make(chan auditRecord, auditBuffer), done: make(chan struct{})}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		a.url = target
+		a.client = &http.Client{Timeout: 10 * time.Second}
+	} else {
+		a.path = target
+		if err := a.reopen(); err != nil {
+			return nil, err
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := a.reopen(); err != nil {
+					logger.Errorf("Reopening AUDIT_LOG: %v", err)
+					continue
+				}
+				logger.Infof("Reopened AUDIT_LOG %s", a.path)
+			}
+		}()
+	}
+	go a.run()
+	return a, nil
+}
+
+// reopen switches to a fresh handle on the log's path, keeping the old one
+// if the file can't be opened. Prompts are sensitive, so it is created
+// readable by the proxy's user alone.
+func (a *auditLog) reopen() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = f
+	return nil
+}
+
+// record queues a record without waiting. If the buffer is full the record
+// is dropped and the loss logged, rather than stalling the request.
+func (a *auditLog) record(rec auditRecord) {
+	select {
+	case a.records <- rec:
+	default:
+		a.mu.Lock()
+		a.dropped++
+		dropped := a.dropped
+		a.mu.Unlock()
+		logger.Errorf("AUDIT_LOG can't keep up: dropped the record for request %s (%d dropped so far)", rec.RequestID, dropped)
+	}
+}
+
+func (a *auditLog) run() {
+	defer close(a.done)
+	for rec := range a.records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			logger.Errorf("Encoding an AUDIT_LOG record: %v", err)
+			continue
+		}
+		if a.url != "" {
+			a.post(data)
+			continue
+		}
+		a.mu.Lock()
+		_, err = a.file.Write(append(data, '\n'))
+		a.mu.Unlock()
+		if err != nil {
+			logger.Errorf("Writing AUDIT_LOG: %v", err)
+		}
+	}
+}
+
+func (a *auditLog) post(data []byte) {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(data))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		logger.Errorf("Sending AUDIT_LOG record: %v", err)
+	}
+}
+
+// close writes out whatever is still queued, waiting up to timeout
+func (a *auditLog) close(timeout time.Duration) {
+	close(a.records)
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		logger.Warnf("AUDIT_LOG still had %d records to write at exit", len(a.records))
+	}
+}
+
+// audit records a finished CLI run in AUDIT_LOG, if it is on
+func (run *claudeRun) audit(stream bool, result claudeResult, err error) {
+	if audit == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:         time.Now(),
+		Started:      run.started,
+		Model:        run.Model,
+		Stream:       stream,
+		User:         run.Req.User,
+		SystemPrompt: run.cliSystem,
+		UserPrompt:   run.cliInput,
+		Response:     result.Text,
+		StopReason:   result.StopReason,
+		Cache:        run.cacheStatus,
+	}
+	rec.RequestID, _ = run.log.field("request_id").(string)
+	rec.Key, _ = run.log.field("key").(string)
+	rec.Client, _ = run.log.field("client").(string)
+	switch {
+	case err != nil:
+		rec.Error = err.Error()
+	case result.Err != nil:
+		rec.Error = result.Err.Error()
+	}
+	audit.record(rec)
+}
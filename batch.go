@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// maxBatchSize caps how many requests one batch may hold, from
+// MAX_BATCH_SIZE
+var maxBatchSize = 16
+
+// isBatch reports whether a chat completion body is a batch: a JSON array of
+// requests instead of one request object
+func isBatch(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// handleChatBatch answers a batch of chat completion requests with an array
+// of responses in the same order. Each item is served like a request of its
+// own, with the batch's headers, so it gets exactly the response it would
+// have alone: a completion, or the error it failed with. The items run at
+// once, each taking its turn for a CLI slot like any other request.
+func handleChatBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		sendError(w, "A batch must hold at least one request", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchSize {
+		sendError(w, fmt.Sprintf("A batch may hold at most %d requests", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+	loggerFrom(r.Context()).Infof("Batch of %d requests", len(items))
+
+	responses := make([]json.RawMessage, len(items))
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = serveBatchItem(r, i, items[i])
+		}(i)
+	}
+	wg.Wait()
+	// A cancelled batch is answered by cancellable, if at all
+	if r.Context().Err() != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(responses)
+}
+
+// serveBatchItem runs one batch item through handleChat and returns the body
+// it answered with. The batch as a whole spent one RATE_LIMIT_RPM token, so
+// every further item spends one of its own. Sessions are per conversation,
+// so X-Conversation-Id is ignored. Items that aren't request objects, or ask
+// to stream, get an error of their own.
+func serveBatchItem(r *http.Request, i int, item json.RawMessage) json.RawMessage {
+	rec := httptest.NewRecorder()
+	var probe struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(item, &probe); err != nil || bytes.TrimSpace(item)[0] != '{' {
+		sendError(rec, "A batch item must be a request object", http.StatusBadRequest)
+		return bytes.TrimSpace(rec.Body.Bytes())
+	}
+	if probe.Stream {
+		sendError(rec, "Streaming is not supported in a batch", http.StatusBadRequest)
+		return bytes.TrimSpace(rec.Body.Bytes())
+	}
+
+	ctx := withLogger(r.Context(), loggerFrom(r.Context()).With("batch_item", i))
+	sub := r.Clone(ctx)
+	sub.Body = io.NopCloser(bytes.NewReader(item))
+	sub.ContentLength = int64(len(item))
+	sub.Header.Set("Content-Length", strconv.Itoa(len(item)))
+	sub.Header.Del("Content-Encoding")
+	sub.Header.Del("X-Conversation-Id")
+	// Batches never stream, whatever FORCE_STREAMING says
+	sub.Header.Set("X-Proxy-Stream", "false")
+
+	limiter, _, _ := rateLimiters()
+	if key := requestKey(r); limiter != nil && i > 0 && key != "" {
+		if ok, _, wait := limiter.take(key); !ok {
+			loggerFrom(ctx).Warnf("Rate limit of %d requests/minute exceeded", limiter.rpm)
+			sendRateLimited(rec, sub, wait, "Rate limit exceeded, try again later")
+			return bytes.TrimSpace(rec.Body.Bytes())
+		}
+	}
+	if i > 0 && !allowIP(rec, sub) {
+		return bytes.TrimSpace(rec.Body.Bytes())
+	}
+	handleChat(rec, sub)
+	if rec.Body.Len() == 0 {
+		// Only a request cut short answers with nothing, so this isn't sent
+		return json.RawMessage("null")
+	}
+	return bytes.TrimSpace(rec.Body.Bytes())
+}
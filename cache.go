@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCache is an LRU of non-streaming CLI results, so repeating a
+// deterministic request doesn't spend quota twice. Entries expire after the
+// TTL and the least recently used one goes once the cache is full.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	result  claudeResult
+	expires time.Time
+}
+
+// cache is nil when RESPONSE_CACHE_SIZE is 0
+var cache *responseCache
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *responseCache) get(key string) (claudeResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return claudeResult{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return claudeResult{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry.result, true
+}
+
+func (c *responseCache) put(key string, result claudeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).result = result
+		el.Value.(*cacheEntry).expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, result: result, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// sweep drops expired entries, which otherwise linger until looked up or
+// pushed out, and returns how many it dropped
+func (c *responseCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for key, el := range c.entries {
+		if now.After(el.Value.(*cacheEntry).expires) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// useCache decides whether run's result may come from, and go into, the
+// response cache. Requests at temperature 0 are cached unless the client
+// sends X-Proxy-Cache: false; X-Proxy-Cache: true caches any request.
+// Streams, n > 1, conversations and images are never cached; the latter two
+// depend on more than the prompt.
+func (run *claudeRun) useCache(header string) {
+	if cache == nil || run.Req.Stream || run.choices() > 1 || run.conversation != "" || run.ImageDir != "" {
+		return
+	}
+	wanted := run.Req.Temperature != nil && *run.Req.Temperature == 0
+	if v, err := strconv.ParseBool(strings.TrimSpace(header)); err == nil {
+		wanted = v
+	}
+	if wanted {
+		run.cacheKey = run.responseCacheKey()
+	}
+}
+
+// responseCacheKey hashes everything the CLI sees: its arguments (model,
+// system prompt), its input and the directory it runs in. Stop sequences,
+// max_tokens and POST_HOOK are applied by the proxy rather than the CLI, so
+// they are part of the key too.
+func (run *claudeRun) responseCacheKey() string {
+	applied := strconv.Itoa(run.Req.maxTokens()) + "\x00" + strings.Join(run.Req.Stop, "\x00") + "\x00" + strings.Join(postHook, "\x00")
+	return hashText(strings.Join(run.args(false), "\x00") + "\x00" + run.workdir + "\x00" + run.cliInput + "\x00" + applied)
+}
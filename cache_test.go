@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCacheSkipsFailedOpenHook has POST_HOOK fail under HOOK_FAILURE=open,
+// and checks the unfiltered reply it lets through is never served from the
+// cache once the hook works again
+func TestCacheSkipsFailedOpenHook(t *testing.T) {
+	setupProxy(t)
+	cache = newResponseCache(10, time.Minute)
+	hookFailOpen = true
+	broken := filepath.Join(t.TempDir(), "broken")
+	if err := os.WriteFile(broken, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	postHook = []string{"sh", "-c", "test -e " + broken + " && exit 1; tr a-z A-Z"}
+	fakeOutput(t, false, jsonLine(t, map[string]interface{}{"type": "result", "subtype": "success", "result": "hello"}))
+
+	for _, want := range []struct {
+		fixed  bool
+		text   string
+		status string
+	}{
+		{false, "hello", "miss"},
+		{true, "HELLO", "miss"},
+		{true, "HELLO", "hit"},
+	} {
+		if want.fixed {
+			os.Remove(broken)
+		}
+		w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "temperature": 0,
+			"messages": [{"role": "user", "content": "Say hello"}]}`)
+		var resp ChatResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		text := resp.Choices[0].Message.Content.Text
+		if status := w.Header().Get("X-Proxy-Cache"); text != want.text || status != want.status {
+			t.Errorf("hook fixed %v: got %q (cache %s), want %q (cache %s)", want.fixed, text, status, want.text, want.status)
+		}
+	}
+}
+
+// TestCacheKeyPostHook checks replies rewritten by different POST_HOOKs
+// don't share a cache entry
+func TestCacheKeyPostHook(t *testing.T) {
+	setupProxy(t)
+	run := &claudeRun{Req: ChatRequest{Model: "sonnet"}, Model: "sonnet", cliInput: "Say hello"}
+	before := run.responseCacheKey()
+	postHook = []string{"tr", "a-z", "A-Z"}
+	if run.responseCacheKey() == before {
+		t.Error("POST_HOOK doesn't change the cache key")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errCancelled is the cause of a request context ended through /v1/cancel
+var errCancelled = errors.New("request cancelled through /v1/cancel")
+
+// statusCancelled is what a cancelled request gets if nothing was sent yet:
+// nginx's "client closed request", as the client asked for it to end
+const statusCancelled = 499
+
+// activeRun is a CLI request that can be cancelled by its ID
+type activeRun struct {
+	key    string // the proxy key it came with; only that key may cancel it
+	cancel context.CancelCauseFunc
+}
+
+// activeRuns maps X-Request-Id to the CLI requests being served. A request
+// whose client-supplied ID is already taken is served but can't be cancelled.
+var activeRuns = struct {
+	sync.Mutex
+	byID map[string]*activeRun
+}{byID: map[string]*activeRun{}}
+
+// cancellable registers a CLI request under its ID for the length of the
+// request, so /v1/cancel can end it even while the connection stays open.
+// Cancelling kills the CLI, which is bound to the request context. A request
+// cancelled before it sent anything gets a 499; a stream just ends.
+func cancellable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := loggerFrom(r.Context()).field("request_id").(string)
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		entry := &activeRun{key: requestKey(r), cancel: cancel}
+
+		activeRuns.Lock()
+		if _, taken := activeRuns.byID[id]; taken || id == "" {
+			entry = nil
+		} else {
+			activeRuns.byID[id] = entry
+		}
+		activeRuns.Unlock()
+		if entry != nil {
+			defer func() {
+				activeRuns.Lock()
+				delete(activeRuns.byID, id)
+				activeRuns.Unlock()
+			}()
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(ctx))
+		if rec.status == 0 && errors.Is(context.Cause(ctx), errCancelled) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path == "/v1/messages" {
+				sendAnthropicError(w, "Request was cancelled", statusCancelled)
+			} else {
+				writeError(w, statusCancelled, "invalid_request_error", "request_cancelled", "Request was cancelled")
+			}
+		}
+	}
+}
+
+// CancelRequest is the /v1/cancel payload
+type CancelRequest struct {
+	RequestID string `json:"request_id"`
+}
+
+// handleCancel ends an in-flight request by the X-Request-Id it was served
+// under. Requests sent with another key are reported as not found, like ones
+// that already finished.
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authorized(r) {
+		sendError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, status, err := readBody(w, r)
+	if err != nil {
+		sendError(w, err.Error(), status)
+		return
+	}
+	var req CancelRequest
+	if err := decodeRequest(body, &req); err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := strings.TrimSpace(req.RequestID)
+	if id == "" {
+		sendError(w, "request_id is required", http.StatusBadRequest)
+		return
+	}
+
+	activeRuns.Lock()
+	entry, ok := activeRuns.byID[id]
+	if ok && entry.key != requestKey(r) {
+		ok = false
+	}
+	activeRuns.Unlock()
+	if !ok {
+		sendError(w, "No active request with that ID", http.StatusNotFound)
+		return
+	}
+	entry.cancel(errCancelled)
+	loggerFrom(r.Context()).Infof("Cancelled request %s", id)
+	json.NewEncoder(w).Encode(map[string]interface{}{"request_id": id, "cancelled": true})
+}
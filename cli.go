@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// claudeBin is the CLI executable, a name looked up on PATH or a path, from
+// CLAUDE_BIN
+var claudeBin = "claude"
+
+// claudeWorkdir is the directory the CLI runs in, from CLAUDE_WORKDIR. It
+// decides which project context (CLAUDE.md and so on) the CLI picks up. When
+// empty the CLI inherits the proxy's own directory.
+var claudeWorkdir string
+
+// checkWorkdir resolves dir to an absolute path with symlinks evaluated, and
+// checks it is a directory
+func checkWorkdir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// useWorkdir picks the directory run's CLI runs in. A client may choose a
+// subdirectory of CLAUDE_WORKDIR with the X-Claude-Workdir header, but never
+// anything outside it.
+func (run *claudeRun) useWorkdir(header string) error {
+	run.workdir = claudeWorkdir
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+	if claudeWorkdir == "" {
+		return fmt.Errorf("X-Claude-Workdir requires CLAUDE_WORKDIR to be configured")
+	}
+	dir, err := checkWorkdir(filepath.Join(claudeWorkdir, header))
+	if err != nil {
+		return fmt.Errorf("invalid X-Claude-Workdir: %v", err)
+	}
+	if rel, err := filepath.Rel(claudeWorkdir, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid X-Claude-Workdir: must be inside CLAUDE_WORKDIR")
+	}
+	run.workdir = dir
+	run.log.Infof("Running the CLI in %s", dir)
+	return nil
+}
+
+// cliSchema selects how stream-json output is read, from CLI_SCHEMA_VERSION.
+// 1 takes text from each complete assistant message. 2 runs the CLI with
+// --include-partial-messages and takes text from the raw stream_event
+// deltas instead, so it arrives token by token on CLIs that support it.
+var cliSchema = 1
+
+// streamEventDelta returns the kind ("text" or "thinking") and text of a
+// schema 2 stream_event line, if it is a delta of either
+func streamEventDelta(msg map[string]interface{}) (string, string) {
+	event, _ := msg["event"].(map[string]interface{})
+	if eventType, _ := event["type"].(string); eventType != "content_block_delta" {
+		return "", ""
+	}
+	delta, _ := event["delta"].(map[string]interface{})
+	switch deltaType, _ := delta["type"].(string); deltaType {
+	case "text_delta":
+		text, _ := delta["text"].(string)
+		return "text", text
+	case "thinking_delta":
+		thinking, _ := delta["thinking"].(string)
+		return "thinking", thinking
+	}
+	return "", ""
+}
+
+// logLinePattern matches lines that look like a program's log output: a
+// timestamp or a level up front
+var logLinePattern = regexp.MustCompile(`(?i)^\s*(\[?\d{4}-\d{2}-\d{2}|\[?(trace|debug|info|note|warn|warning|error)\b)`)
+
+// looksLikeLogLine tells a CLI log line that strayed onto stdout apart from
+// output that is plain garbage
+func looksLikeLogLine(line string) bool {
+	return logLinePattern.MatchString(line)
+}
+
+// maxCLILineBytes bounds one line of stream-json output, so a runaway CLI
+// can't make the proxy buffer without limit
+const maxCLILineBytes = 64 << 20
+
+// readLine reads one line without its line ending. Unlike bufio.Scanner it
+// has no fixed buffer; a line is only refused once it passes max bytes. A
+// final line without a newline is returned as is, and io.EOF after it.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			return "", fmt.Errorf("CLI output line exceeds %d bytes", max)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		return strings.TrimRight(string(line), "\r\n"), err
+	}
+}
+
+// cliVersion is what `claude --version` last printed. Readiness checks
+// refresh it, so a CLI that auto-updated underneath the proxy shows up.
+var cliVersion atomic.Value // string
+
+// setCLIVersion records the CLI's version output, logging the first one and
+// any change
+func setCLIVersion(output string) {
+	v, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	if v == "" {
+		return
+	}
+	switch old, _ := cliVersion.Load().(string); old {
+	case v:
+		return
+	case "":
+		logger.Infof("Claude CLI version: %s", v)
+	default:
+		logger.Warnf("Claude CLI version changed from %s to %s", old, v)
+	}
+	cliVersion.Store(v)
+}
+
+// withCLIVersion adds the X-Claude-CLI-Version header to an endpoint's
+// responses, once the version is known
+func withCLIVersion(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v, _ := cliVersion.Load().(string); v != "" {
+			w.Header().Set("X-Claude-CLI-Version", v)
+		}
+		next(w, r)
+	}
+}
+
+// errCLIMissing means the CLI executable could not be found
+var errCLIMissing = errors.New("claude CLI not found")
+
+// startError marks a failure to start the CLI because the executable is
+// missing, so handlers can answer with a 503 instead of a generic failure
+func startError(err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", errCLIMissing, err)
+	}
+	return err
+}
+
+// sendCLIMissing rejects a request whose CLI run couldn't start because the
+// executable is missing, using the error writer of whichever API flavor the
+// client speaks
+func sendCLIMissing(w http.ResponseWriter, send func(http.ResponseWriter, string, int)) {
+	send(w, fmt.Sprintf("claude CLI not found (%q): install it on the proxy host or set CLAUDE_BIN to its path", claudeBin), http.StatusServiceUnavailable)
+}
+
+// claudeEnv holds NAME=value pairs set for the CLI only, on top of the
+// proxy's own environment, from CLAUDE_ENV
+var claudeEnv []string
+
+// parseClaudeEnv reads CLAUDE_ENV, either a JSON object or "K=V,K=V". PATH
+// may not be set: CLAUDE_BIN is looked up on the proxy's PATH, and the CLI's
+// own tools need it intact.
+func parseClaudeEnv(v string) ([]string, error) {
+	raw := map[string]string{}
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, err
+		}
+	} else if v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected NAME=value, got %q", pair)
+			}
+			raw[strings.TrimSpace(name)] = value
+		}
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		if name == "" || strings.ContainsAny(name, "= \t\n") {
+			return nil, fmt.Errorf("invalid variable name %q", name)
+		}
+		if strings.EqualFold(name, "PATH") {
+			return nil, fmt.Errorf("PATH can't be overridden")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		env = append(env, name+"="+raw[name])
+	}
+	return env, nil
+}
+
+// extraArgs are appended to every CLI invocation, from CLAUDE_EXTRA_ARGS
+var extraArgs []string
+
+// reservedFlags are set by the proxy itself; overriding them would break how
+// it talks to the CLI, so CLAUDE_EXTRA_ARGS may not contain them
+var reservedFlags = map[string]bool{
+	"-p":              true,
+	"--print":         true,
+	"--model":         true,
+	"--output-format": true,
+	"--input-format":  true,
+	"--system-prompt": true,
+	"-c":              true,
+	"--continue":      true,
+	"-r":              true,
+	"--resume":        true,
+}
+
+// parseExtraArgs tokenizes CLAUDE_EXTRA_ARGS and rejects any flag the proxy
+// manages itself
+func parseExtraArgs(v string) ([]string, error) {
+	args, err := splitArgs(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		flag, _, _ := strings.Cut(arg, "=")
+		if reservedFlags[flag] {
+			return nil, fmt.Errorf("%s is set by the proxy and can't be overridden", flag)
+		}
+	}
+	return args, nil
+}
+
+// defaultArgTemplate is how the proxy invokes the CLI unless
+// CLAUDE_ARG_TEMPLATE says otherwise
+const defaultArgTemplate = "--print --model {model} --output-format {output_format} {stream_flags} {system} {resume} {images}"
+
+// argTemplate is CLAUDE_ARG_TEMPLATE split into words. Values go into
+// {model}, {output_format}, {system_prompt} and {session_id} wherever they
+// appear in a word. The flag groups stand alone as words, and expand to
+// nothing when they don't apply: {stream_flags} (what stream-json needs),
+// {system} (--system-prompt), {resume} (--resume) and {images} (--add-dir
+// for images).
+var argTemplate []string
+
+var (
+	argValues    = map[string]bool{"{model}": true, "{output_format}": true, "{system_prompt}": true, "{session_id}": true}
+	argGroups    = map[string]bool{"{stream_flags}": true, "{system}": true, "{resume}": true, "{images}": true}
+	placeholders = regexp.MustCompile(`\{[a-z_]+\}`)
+)
+
+// parseArgTemplate splits CLAUDE_ARG_TEMPLATE and checks its placeholders.
+// {output_format} is required, as the proxy can only read the formats it
+// asks for. warnings lists what the template leaves out that requests may
+// rely on.
+func parseArgTemplate(v string) (words, warnings []string, err error) {
+	if words, err = splitArgs(v); err != nil {
+		return nil, nil, err
+	}
+	seen := map[string]bool{}
+	for _, word := range words {
+		for _, p := range placeholders.FindAllString(word, -1) {
+			switch {
+			case argGroups[p] && p != word:
+				return nil, nil, fmt.Errorf("%s expands to whole arguments and must stand alone", p)
+			case !argGroups[p] && !argValues[p]:
+				return nil, nil, fmt.Errorf("unknown placeholder %s", p)
+			}
+			seen[p] = true
+		}
+	}
+	if !seen["{output_format}"] {
+		return nil, nil, fmt.Errorf("{output_format} is required")
+	}
+	if !seen["{stream_flags}"] && !slices.Contains(words, "--verbose") {
+		warnings = append(warnings, "without {stream_flags}, streaming needs --verbose in the template")
+	}
+	if !seen["{model}"] {
+		warnings = append(warnings, "without {model}, requests can't choose a model")
+	}
+	if !seen["{system}"] && !seen["{system_prompt}"] {
+		warnings = append(warnings, "without {system} or {system_prompt}, system prompts are dropped")
+	}
+	if !seen["{resume}"] && !seen["{session_id}"] {
+		warnings = append(warnings, "without {resume} or {session_id}, conversations can't resume their sessions")
+	}
+	return words, warnings, nil
+}
+
+// splitArgs splits s into words the way a POSIX shell would, honoring single
+// quotes, double quotes and backslash escapes. Nothing is expanded.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
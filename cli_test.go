@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStreamSchemas streams recorded output of each CLI_SCHEMA_VERSION,
+// with the thinking, tool use and unknown events a verbose CLI mixes in, and
+// checks the client gets the reply text once and nothing else
+func TestStreamSchemas(t *testing.T) {
+	for _, tt := range []struct {
+		schema  int
+		fixture string
+		deltas  []string
+	}{
+		{1, "text_schema1.jsonl", []string{"The capital of France", " is Paris."}},
+		{2, "text_schema2.jsonl", []string{"The capital", " of France", " is Paris."}},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			setupProxy(t)
+			cliSchema = tt.schema
+			t.Setenv("FAKE_CLAUDE_STREAM", filepath.Join("testdata", "stream", tt.fixture))
+
+			w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "stream": true, "stream_options": {"include_usage": true},
+				"messages": [{"role": "user", "content": "What is the capital of France?"}]}`)
+			var deltas []string
+			var usage *Usage
+			for _, chunk := range streamChunks(t, w.Body.String()) {
+				if chunk.Usage != nil {
+					usage = chunk.Usage
+				}
+				for _, choice := range chunk.Choices {
+					if choice.Delta == nil {
+						continue
+					}
+					if choice.Delta.ReasoningContent != "" || len(choice.Delta.ToolCalls) > 0 {
+						t.Errorf("unexpected delta: %+v", choice.Delta)
+					}
+					if choice.Delta.Content != "" {
+						deltas = append(deltas, choice.Delta.Content)
+					}
+				}
+			}
+			if strings.Join(deltas, "|") != strings.Join(tt.deltas, "|") {
+				t.Errorf("deltas = %q, want %q", deltas, tt.deltas)
+			}
+			if usage == nil || usage.PromptTokens != 30 || usage.CompletionTokens != 9 {
+				t.Errorf("usage = %+v, want the CLI's 30 prompt and 9 completion tokens", usage)
+			}
+		})
+	}
+}
+
+func TestParseArgTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		template string
+		err      string
+	}{
+		{defaultArgTemplate, ""},
+		{"--print --output-format {output_format} --x={system}", "{system} expands to whole arguments and must stand alone"},
+		{"--print --output-format {output_format} {sampling}", "unknown placeholder {sampling}"},
+		{"--print --model {model}", "{output_format} is required"},
+	} {
+		_, _, err := parseArgTemplate(tt.template)
+		if got := fmt.Sprint(err); tt.err == "" && err != nil || tt.err != "" && got != tt.err {
+			t.Errorf("parseArgTemplate(%q) = %v, want %q", tt.template, err, tt.err)
+		}
+	}
+}
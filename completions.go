@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Legacy OpenAI text completion structures, for older integrations that still
+// call /v1/completions with a flat prompt instead of messages
+type CompletionRequest struct {
+	Model         string         `json:"model"`
+	Prompt        CompletionText `json:"prompt"`
+	MaxTokens     *int           `json:"max_tokens,omitempty"`
+	Stream        bool           `json:"stream"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	TopP          *float64       `json:"top_p,omitempty"`
+	Stop          StopList       `json:"stop,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	PresencePenalty  *float64           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64           `json:"frequency_penalty,omitempty"`
+	LogitBias        map[string]float64 `json:"logit_bias,omitempty"`
+	Logprobs         *int               `json:"logprobs,omitempty"` // legacy: how many top logprobs to return
+	User             string             `json:"user,omitempty"`
+}
+
+// CompletionText is the legacy prompt, which may be a string or an array of
+// strings. Only a single prompt per request is supported.
+type CompletionText string
+
+func (p *CompletionText) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*p = CompletionText(s)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("prompt must be a string or an array of strings")
+	}
+	if len(list) > 1 {
+		return fmt.Errorf("only one prompt per request is supported")
+	}
+	if len(list) == 1 {
+		*p = CompletionText(list[0])
+	}
+	return nil
+}
+
+type CompletionResponse struct {
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint *string            `json:"system_fingerprint"` // always null
+	Choices           []CompletionChoice `json:"choices"`
+	Usage             *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     *string `json:"logprobs"` // always null
+	FinishReason *string `json:"finish_reason"`
+}
+
+// toChatRequest runs the prompt as a single user message, which the CLI
+// receives verbatim
+func (c CompletionRequest) toChatRequest() ChatRequest {
+	var logprobs *bool
+	if c.Logprobs != nil && *c.Logprobs > 0 {
+		wanted := true
+		logprobs = &wanted
+	}
+	return ChatRequest{
+		Model:         c.Model,
+		Messages:      []Message{{Role: "user", Content: MessageContent{Text: string(c.Prompt)}}},
+		Stream:        c.Stream,
+		Temperature:   c.Temperature,
+		TopP:          c.TopP,
+		MaxTokens:     c.MaxTokens,
+		Stop:          c.Stop,
+		StreamOptions: c.StreamOptions,
+
+		PresencePenalty:  c.PresencePenalty,
+		FrequencyPenalty: c.FrequencyPenalty,
+		LogitBias:        c.LogitBias,
+		Logprobs:         logprobs,
+		User:             c.User,
+	}
+}
+
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Allow", "POST")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, status, err := readBody(w, r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, err.Error(), status)
+		return
+	}
+
+	var creq CompletionRequest
+	if err := decodeRequest(body, &creq); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if creq.Prompt == "" {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, "prompt is required", http.StatusBadRequest)
+		return
+	}
+
+	reqLog := loggerFrom(r.Context())
+	reqLog.Debugf("=== INCOMING COMPLETION REQUEST ===")
+	reqLog.Debugf("Model requested: %s, stream: %v, prompt: %d chars", creq.Model, creq.Stream, len(creq.Prompt))
+
+	req := creq.toChatRequest()
+	req.useModelHeader(r.Header.Get("X-Claude-Model"))
+	if !allowUser(w, r, req.User) {
+		return
+	}
+	run, cleanup, err := prepareRun(r.Context(), req)
+	defer cleanup()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendRequestError(w, err)
+		return
+	}
+
+	if isDryRun(r) {
+		sendDryRun(w, run, creq.Stream)
+		return
+	}
+	if err := run.useWorkdir(r.Header.Get("X-Claude-Workdir")); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	run.useCache(r.Header.Get("X-Proxy-Cache"))
+	run.debugStderr = debugStream(r)
+	run.showTiming = showTiming(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if creq.Stream {
+		handleCompletionStreaming(ctx, w, run)
+	} else {
+		handleCompletionNonStreaming(ctx, w, run)
+	}
+}
+
+func handleCompletionNonStreaming(ctx context.Context, w http.ResponseWriter, run *claudeRun) {
+	w.Header().Set("Content-Type", "application/json")
+
+	result, err := runClaude(ctx, run)
+	if clientGone(ctx, run) {
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		run.log.Errorf("Claude CLI timed out after %v", requestTimeout)
+		sendError(w, fmt.Sprintf("Claude CLI timed out after %v", requestTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errBusy) {
+		sendBusy(w, err, sendError)
+		return
+	}
+	if errors.Is(err, errCLIMissing) {
+		sendCLIMissing(w, sendError)
+		return
+	}
+	if err != nil {
+		sendRunFailure(w, err, sendError)
+		return
+	}
+
+	finishReason := openAIFinishReason(result.StopReason)
+	run.setResultHeaders(w)
+	json.NewEncoder(w).Encode(CompletionResponse{
+		ID:      fmt.Sprintf("cmpl-%d", time.Now().UnixNano()),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   run.Model,
+		Choices: []CompletionChoice{{
+			Text:         result.Text,
+			FinishReason: &finishReason,
+		}},
+		Usage: openAIUsage(w, run, result),
+	})
+}
+
+func handleCompletionStreaming(ctx context.Context, w http.ResponseWriter, run *claudeRun) {
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Trailer", "X-Usage-Source, X-Model-Used, X-Time-To-First-Token-Ms, X-Proxy-Timing")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	id := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	chunk := func(text string, finishReason *string) CompletionResponse {
+		return CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   run.Model,
+			Choices: []CompletionChoice{{Text: text, FinishReason: finishReason}},
+		}
+	}
+
+	var mu sync.Mutex
+	pings := newPinger(w, flusher, &mu)
+	run.onStart = pings.start
+	if run.debugStderr {
+		run.onStderr = pings.stderr
+	}
+	sent := false
+	result, err := streamClaude(ctx, run, func(text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		sendSSEData(w, flusher, chunk(text, nil))
+		sent = true
+	}, nil)
+	if pings.stop() {
+		sent = true
+	}
+	if clientGone(ctx, run) {
+		return
+	}
+	if errors.Is(err, errBusy) {
+		w.Header().Set("Content-Type", "application/json")
+		sendBusy(w, err, sendError)
+		return
+	}
+	if errors.Is(err, errCLIMissing) {
+		w.Header().Set("Content-Type", "application/json")
+		sendCLIMissing(w, sendError)
+		return
+	}
+	if err != nil {
+		sendSSEError(w, flusher, http.StatusInternalServerError, "Failed to start Claude CLI")
+		return
+	}
+	// Partial text ends normally, with finish_reason "length"
+	if ctx.Err() == context.DeadlineExceeded && !result.TimedOut {
+		run.log.Errorf("Streaming request timed out after %v", requestTimeout)
+		sendSSEError(w, flusher, http.StatusGatewayTimeout, fmt.Sprintf("Claude CLI timed out after %v", requestTimeout))
+		return
+	}
+	if result.Err != nil {
+		if !sent {
+			w.Header().Set("Content-Type", "application/json")
+			sendRunFailure(w, result.Err, sendError)
+			return
+		}
+		finishReason := "error"
+		sendSSEData(w, flusher, chunk("", &finishReason))
+		msg, status := runFailure(result.Err)
+		sendSSEError(w, flusher, status, msg)
+		return
+	}
+
+	finishReason := openAIFinishReason(result.StopReason)
+	sendSSEData(w, flusher, chunk("", &finishReason))
+
+	run.setResultHeaders(w)
+	usage := openAIUsage(w, run, result)
+	if usage != nil && run.Req.includeUsage() {
+		sendSSEData(w, flusher, CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   run.Model,
+			Choices: []CompletionChoice{},
+			Usage:   usage,
+		})
+	}
+
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// sendSSEData writes any payload as an unnamed SSE data line
+func sendSSEData(w http.ResponseWriter, flusher http.Flusher, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCompressionRoundTrip sends compressed requests to a server behind
+// compress, asking for gzip back, and checks JSON replies come gzipped while
+// streams don't
+func TestCompressionRoundTrip(t *testing.T) {
+	setupProxy(t)
+	server := httptest.NewServer(compress(http.HandlerFunc(handleChat)))
+	defer server.Close()
+	// Left to itself the client would decompress the reply behind our back
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, tt := range []struct {
+		name     string
+		encoding string
+		stream   bool
+	}{
+		{"gzip", "gzip", false},
+		{"deflate", "deflate", false},
+		{"gzip stream", "gzip", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			zw := io.WriteCloser(gzip.NewWriter(&body))
+			if tt.encoding == "deflate" {
+				zw = zlib.NewWriter(&body)
+			}
+			json.NewEncoder(zw).Encode(map[string]interface{}{
+				"model":    "sonnet",
+				"stream":   tt.stream,
+				"messages": []map[string]string{{"role": "user", "content": "Hi"}},
+			})
+			zw.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, server.URL, &body)
+			req.Header.Set("Authorization", "Bearer "+testKey)
+			req.Header.Set("Content-Encoding", tt.encoding)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				data, _ := io.ReadAll(resp.Body)
+				t.Fatalf("status %d: %s", resp.StatusCode, data)
+			}
+
+			if tt.stream {
+				if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+					t.Fatalf("stream sent with Content-Encoding %s", enc)
+				}
+				data, _ := io.ReadAll(resp.Body)
+				var text string
+				for _, chunk := range streamChunks(t, string(data)) {
+					for _, choice := range chunk.Choices {
+						if choice.Delta != nil {
+							text += choice.Delta.Content
+						}
+					}
+				}
+				if text != "Hello from the fake CLI" {
+					t.Errorf("streamed %q", text)
+				}
+				return
+			}
+
+			if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", enc)
+			}
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reply ChatResponse
+			if err := json.NewDecoder(zr).Decode(&reply); err != nil {
+				t.Fatal(err)
+			}
+			if text := reply.Choices[0].Message.Content.Text; text != "Hello from the fake CLI" {
+				t.Errorf("reply = %q", text)
+			}
+		})
+	}
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer "+testKey)
+		req.Header.Set("Content-Encoding", "br")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("status %d, want 415", resp.StatusCode)
+		}
+	})
+}
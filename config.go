@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// validateConfig rejects settings that only make sense together, or that
+// contradict each other, before anything starts listening. Each setting's
+// own syntax is checked where it is parsed; this is for the combinations.
+func validateConfig() error {
+	set := func(name string) bool { return strings.TrimSpace(os.Getenv(name)) != "" }
+
+	// With LISTEN_SOCKET set, PORT is ignored (main says so), not refused
+	if !set("LISTEN_SOCKET") {
+		if set("LISTEN_SOCKET_MODE") {
+			return fmt.Errorf("LISTEN_SOCKET_MODE needs LISTEN_SOCKET")
+		}
+		if port := strings.TrimSpace(os.Getenv("PORT")); port != "" {
+			if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+				return fmt.Errorf("PORT must be a number from 0 to 65535, not %q", port)
+			}
+		}
+	}
+	if set("TLS_CERT_FILE") != set("TLS_KEY_FILE") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if set("EMBEDDINGS_UPSTREAM_KEY") && !set("EMBEDDINGS_UPSTREAM_URL") {
+		return fmt.Errorf("EMBEDDINGS_UPSTREAM_KEY needs EMBEDDINGS_UPSTREAM_URL")
+	}
+	if forceStreaming && forceNonStreaming {
+		return fmt.Errorf("Set only one of FORCE_STREAMING and FORCE_NON_STREAMING")
+	}
+	if set("RESPONSE_CACHE_TTL") && cache == nil {
+		return fmt.Errorf("RESPONSE_CACHE_TTL needs RESPONSE_CACHE_SIZE")
+	}
+	return checkAllowedModels(allowedModels)
+}
+
+// checkAllowedModels rejects an ALLOWED_MODELS that leaves out CLAUDE_MODEL
+// or a MODEL_FALLBACK model. It is checked at startup and on every reload.
+func checkAllowedModels(allowed map[string]bool) error {
+	if allowed == nil {
+		return nil
+	}
+	// Every request without a model would be refused
+	if !allowed[defaultModel] {
+		return fmt.Errorf("CLAUDE_MODEL %s is not in ALLOWED_MODELS", defaultModel)
+	}
+	for model, fallbacks := range modelFallbacks {
+		for _, fallback := range fallbacks {
+			if !allowed[fallback] {
+				return fmt.Errorf("MODEL_FALLBACK falls back from %s to %s, which is not in ALLOWED_MODELS", model, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+// configSummary lists the effective settings for the startup line: as fields
+// in JSON logs, and in the message itself as the features that are on
+func configSummary(addr, scheme string, maxConcurrent int) (*Logger, []string) {
+	features := []string{}
+	feature := func(on bool, name string) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	feature(limiter != nil, "rate_limit")
+	feature(userLimiter != nil, "user_rate_limit")
+	feature(ipLimiter != nil, "ip_rate_limit")
+	feature(maxQueueDepth > 0, "max_queue_depth")
+	feature(cache != nil, "response_cache")
+	feature(conversations != nil, "conversations")
+	feature(allowedModels != nil, "allowed_models")
+	feature(tokenizer != nil, "tokenizer")
+	feature(len(modelFallbacks) > 0, "model_fallback")
+	feature(len(modelAliases) > 0, "model_aliases")
+	feature(mapEffort, "map_reasoning_effort")
+	feature(proxySystemPrompt != "", "proxy_system_prompt")
+	feature(modelPrompts.dir != "", "model_system_prompts")
+	feature(configFile != "", "config_file")
+	feature(len(preHook) > 0, "pre_hook")
+	feature(len(postHook) > 0, "post_hook")
+	feature(adminKey != "", "admin_reload")
+	feature(userPromptPrefix != "" || userPromptSuffix != "", "user_prompt_wrap")
+	feature(imageInput, "image_input")
+	feature(includeThinking, "thinking")
+	feature(embeddingsProxy != nil, "embeddings")
+	feature(access != nil, "access_log")
+	feature(audit != nil, "audit_log")
+	feature(len(allowNets) > 0 || len(denyNets) > 0, "ip_filter")
+	feature(trustProxy, "trust_proxy")
+	feature(claudeWorkdir != "", "workdir")
+	feature(forceStreaming, "force_streaming")
+	feature(forceNonStreaming, "force_non_streaming")
+	feature(debugMode, "debug")
+
+	log := logger.With(
+		"addr", addr,
+		"scheme", scheme,
+		"default_model", defaultModel,
+		"timeout", requestTimeout.String(),
+		"max_concurrent", maxConcurrent,
+		"queue_timeout", queueTimeout.String(),
+		"history_mode", historyMode,
+		"system_message_policy", systemPolicy,
+		"usage_mode", usageMode,
+		"output_format", outputFormat,
+		"reaper_interval", reaperInterval.String(),
+		"stream_batch", streamBatch.String(),
+		"max_header_bytes", maxHeaderBytes,
+		"max_connections", maxConnections,
+		"features", features,
+	)
+	return log, features
+}
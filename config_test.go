@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// TestValidateConfigListen checks PORT is left to lose to LISTEN_SOCKET
+// rather than refused alongside it
+func TestValidateConfigListen(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"port", map[string]string{"PORT": "8080"}, true},
+		{"socket", map[string]string{"LISTEN_SOCKET": "/tmp/proxy.sock"}, true},
+		{"both", map[string]string{"PORT": "8080", "LISTEN_SOCKET": "/tmp/proxy.sock"}, true},
+		{"socket mode without socket", map[string]string{"LISTEN_SOCKET_MODE": "600"}, false},
+		{"bad port", map[string]string{"PORT": "http"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setupProxy(t)
+			for _, name := range []string{"PORT", "LISTEN_SOCKET", "LISTEN_SOCKET_MODE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if err := validateConfig(); (err == nil) != tt.ok {
+				t.Errorf("validateConfig() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// TestParseModelDefaultsTemperature checks a temperature in MODEL_DEFAULTS
+// stops startup rather than being silently ignored, as the CLI can't apply it
+func TestParseModelDefaultsTemperature(t *testing.T) {
+	if _, err := parseModelDefaults(`{"opus": {"temperature": 0.2}}`); err == nil {
+		t.Error("parseModelDefaults accepted a temperature")
+	}
+	defaults, err := parseModelDefaults(`{"opus": {"max_tokens": 4096, "system_prefix": "Be concise."}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := defaults["opus"]; d.MaxTokens == nil || *d.MaxTokens != 4096 || d.SystemPrefix != "Be concise." {
+		t.Errorf("opus defaults = %+v", d)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// DryRunResponse is what a dry run returns in place of a completion: exactly
+// how the CLI would have been invoked for the request
+type DryRunResponse struct {
+	Object       string   `json:"object"`
+	Model        string   `json:"model"`
+	Command      string   `json:"command"`
+	Args         []string `json:"args"`
+	SystemPrompt string   `json:"system_prompt"`
+	UserPrompt   string   `json:"user_prompt"` // piped to the CLI's stdin
+	Runs         int      `json:"runs"`        // one CLI run per choice
+}
+
+// isDryRun reports whether the client asked to see the CLI invocation
+// instead of running it, with an X-Proxy-Dry-Run header or ?dry_run=1
+func isDryRun(r *http.Request) bool {
+	for _, v := range []string{r.Header.Get("X-Proxy-Dry-Run"), r.URL.Query().Get("dry_run")} {
+		if on, err := strconv.ParseBool(v); err == nil && on {
+			return true
+		}
+	}
+	return false
+}
+
+// sendDryRun answers a dry run with the prepared run's command line. Image
+// paths in the args point at a temp dir that is removed once the request
+// ends.
+func sendDryRun(w http.ResponseWriter, run *claudeRun, stream bool) {
+	run.log.Infof("Dry run, not starting the CLI")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DryRunResponse{
+		Object:       "proxy.dry_run",
+		Model:        run.Model,
+		Command:      claudeBin,
+		Args:         run.args(stream),
+		SystemPrompt: run.cliSystem,
+		UserPrompt:   run.cliInput,
+		Runs:         run.choices(),
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// embeddingsProxy forwards /v1/embeddings to EMBEDDINGS_UPSTREAM_URL, if set
+var embeddingsProxy *httputil.ReverseProxy
+
+// newEmbeddingsProxy sends embeddings requests to target (the upstream's full
+// embeddings URL). The client's proxy key is never passed on; key, if set,
+// is sent upstream as a Bearer token instead.
+func newEmbeddingsProxy(target, key string) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http(s) URL", target)
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			out := *u
+			r.Out.URL = &out
+			r.Out.Host = u.Host
+			r.Out.Header.Del("Authorization")
+			r.Out.Header.Del("X-Api-Key")
+			if key != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+key)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			loggerFrom(r.Context()).Errorf("Embeddings upstream failed: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			sendError(w, "Embeddings upstream unavailable", http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// handleEmbeddings answers embeddings requests, which the Claude CLI can't
+// serve, with a clear OpenAI-shaped error rather than a 404 page, or hands
+// them to a configured upstream
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Allow", "POST")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if embeddingsProxy != nil {
+		embeddingsProxy.ServeHTTP(w, r)
+		return
+	}
+
+	// A 4xx, not 501: the SDKs retry 5xx responses, which can't help here
+	w.Header().Set("Content-Type", "application/json")
+	writeError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_endpoint",
+		"Embeddings are not supported by this proxy: the Claude CLI has no embeddings model")
+}
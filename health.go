@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a readiness probe result is reused, and how long the probe may take
+const (
+	readyCacheTTL = 10 * time.Second
+	readyTimeout  = 5 * time.Second
+)
+
+// readiness caches the last CLI probe so frequent health checks don't each
+// spawn a process
+var readiness struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// cliAvailable is the outcome of the last CLI probe, which /health reads
+// without waiting for one in progress
+var cliAvailable atomic.Bool
+
+// Health is the /health payload
+type Health struct {
+	Status         string `json:"status"` // "ok", or "degraded" if the CLI is unavailable
+	ActiveRequests int64  `json:"active_requests"`
+	QueuedRequests int64  `json:"queued_requests"`
+	CLIAvailable   bool   `json:"cli_available"` // as of the last readiness probe
+	UptimeSeconds  int64  `json:"uptime_seconds"`
+}
+
+// handleHealth is a liveness check: the proxy process is up, so it answers
+// 200 even when the CLI is not. It never runs the CLI itself, leaving that
+// to /ready. Probes that only want "ok" can send Accept: text/plain.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok"))
+		return
+	}
+	health := Health{
+		Status:         "ok",
+		ActiveRequests: atomic.LoadInt64(&activeRequests),
+		QueuedRequests: atomic.LoadInt64(&queueDepth),
+		CLIAvailable:   cliAvailable.Load(),
+		UptimeSeconds:  int64(time.Since(startedAt).Seconds()),
+	}
+	if !health.CLIAvailable {
+		health.Status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
+
+// handleReady reports whether the claude CLI can actually be run, so
+// orchestrators don't route traffic to a proxy whose CLI is missing or broken
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := checkCLI(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "claude CLI unavailable: %v", err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// checkCLI runs `claude --version`, reusing the result for readyCacheTTL.
+// Concurrent callers wait for a single probe rather than starting their own.
+func checkCLI() error {
+	readiness.Lock()
+	defer readiness.Unlock()
+	if !readiness.checked.IsZero() && time.Since(readiness.checked) < readyCacheTTL {
+		return readiness.err
+	}
+
+	// Not tied to any request, so one impatient client can't poison the cache
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := newClaudeCommand(ctx, []string{"--version"})
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("claude --version timed out after %v", readyTimeout)
+	case err != nil && strings.TrimSpace(stderr.String()) != "":
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		logger.Warnf("Readiness check failed: %v", err)
+	} else {
+		setCLIVersion(stdout.String())
+	}
+
+	readiness.checked = time.Now()
+	readiness.err = err
+	cliAvailable.Store(err == nil)
+	return err
+}
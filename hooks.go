@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hooks are commands that see, and may rewrite, what passes through the
+// proxy: PRE_HOOK each request before it is turned into a prompt, POST_HOOK
+// each reply before it reaches the client. Both are split like
+// CLAUDE_EXTRA_ARGS and off by default.
+var (
+	preHook  []string
+	postHook []string
+
+	// hookTimeout (HOOK_TIMEOUT) bounds each hook run
+	hookTimeout = 10 * time.Second
+
+	// hookFailOpen (HOOK_FAILURE=open) carries on without a hook that fails,
+	// times out or prints something unusable. By default such a request
+	// fails, since a hook that redacts or filters is no use skipped.
+	hookFailOpen bool
+)
+
+// errHookFailed means a hook failed and HOOK_FAILURE is closed
+var errHookFailed = errors.New("hook failed")
+
+// errHookRefused means PRE_HOOK refused the request, by exiting with status
+// 2. Its stderr is the reason given to the client.
+var errHookRefused = errors.New("request refused")
+
+// hookRefusal is the exit status by which PRE_HOOK refuses a request
+const hookRefusal = 2
+
+// runHook runs a hook with input on stdin and returns its stdout. It gets
+// the request's ID and model in PROXY_REQUEST_ID and PROXY_MODEL, and which
+// hook it is in PROXY_HOOK. A reply cut short by the client leaving is still
+// passed through whole, so it is detached from the request's cancellation.
+func runHook(ctx context.Context, log *Logger, name string, argv []string, model string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), hookTimeout)
+	defer cancel()
+
+	requestID, _ := log.field("request_id").(string)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), "PROXY_HOOK="+name, "PROXY_REQUEST_ID="+requestID, "PROXY_MODEL="+model)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stdout, cmd.Stderr = &stdout, stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	msg := strings.TrimSpace(string(stderr.buf))
+	var exit *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("timed out after %v", hookTimeout)
+	case errors.As(err, &exit) && exit.ExitCode() == hookRefusal && name == "pre":
+		if msg == "" {
+			msg = "refused by PRE_HOOK"
+		}
+		return nil, fmt.Errorf("%w: %s", errHookRefused, msg)
+	case err != nil && msg != "":
+		err = fmt.Errorf("%v: %s", err, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("%s_HOOK took %v", strings.ToUpper(name), time.Since(start).Round(time.Millisecond))
+	return stdout.Bytes(), nil
+}
+
+// hookFailure applies HOOK_FAILURE to a hook's error: nil to carry on
+// without it, or the error to fail the request with
+func hookFailure(log *Logger, name string, err error) error {
+	if errors.Is(err, errHookRefused) {
+		log.Warnf("PRE_HOOK: %v", err)
+		return err
+	}
+	if hookFailOpen {
+		log.Warnf("%s_HOOK failed, carrying on without it: %v", name, err)
+		return nil
+	}
+	log.Errorf("%s_HOOK failed: %v", name, err)
+	return fmt.Errorf("%w: %s_HOOK: %v", errHookFailed, name, err)
+}
+
+// applyPreHook passes req through PRE_HOOK as JSON, taking back the request
+// it prints. Images aren't part of the JSON, so they stay on their messages
+// as long as the hook keeps the number of messages; stream can't change,
+// since the response has been chosen by now.
+func applyPreHook(ctx context.Context, req ChatRequest) (ChatRequest, error) {
+	log := loggerFrom(ctx)
+	input, err := json.Marshal(req)
+	if err != nil {
+		return req, err
+	}
+	output, err := runHook(ctx, log, "pre", preHook, req.Model, input)
+	var rewritten ChatRequest
+	if err == nil {
+		if err = decodeRequest(output, &rewritten); err != nil {
+			err = fmt.Errorf("printed an unusable request: %v", err)
+		}
+	}
+	if err != nil {
+		return req, hookFailure(log, "PRE", err)
+	}
+
+	if len(rewritten.Messages) == len(req.Messages) {
+		for i := range rewritten.Messages {
+			rewritten.Messages[i].Content.Images = req.Messages[i].Content.Images
+		}
+	} else if hasImages(req.Messages) {
+		log.Warnf("PRE_HOOK changed the number of messages, dropping the request's images")
+	}
+	rewritten.Stream = req.Stream
+	rewritten.modelFromHeader = req.modelFromHeader
+	return rewritten, nil
+}
+
+func hasImages(messages []Message) bool {
+	for _, msg := range messages {
+		if len(msg.Content.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// postHook passes a reply's text through POST_HOOK, which prints the text to
+// send instead. Under HOOK_FAILURE=open a failed hook leaves it unchanged,
+// and marks the run so the reply isn't cached.
+func (run *claudeRun) postHook(ctx context.Context, text string) (string, error) {
+	output, err := runHook(ctx, run.log, "post", postHook, run.Model, []byte(text))
+	if err != nil {
+		run.hookSkipped = true
+		return text, hookFailure(run.log, "POST", err)
+	}
+	return string(output), nil
+}
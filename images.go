@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Largest image we'll accept, decoded or downloaded
+const maxImageBytes = 20 << 20
+
+// Image types Claude can read, mapped to the file extension we save them as
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/jpg":  ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageClient downloads image URLs. Only https is fetched, so a redirect
+// elsewhere, say to a plain http address on the proxy's own network, is
+// refused rather than followed.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect to non-https URL %s", req.URL.Redacted())
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+		return nil
+	},
+}
+
+// materializeImages writes every image_url part in messages to a fresh temp
+// dir and records the file path on the attachment. It returns "" when there
+// are no images. The caller owns the dir and must remove it, including when
+// an error is returned.
+func materializeImages(ctx context.Context, messages []Message) (string, error) {
+	var images []*ImageAttachment
+	for _, msg := range messages {
+		images = append(images, msg.Content.Images...)
+	}
+	if len(images) == 0 {
+		return "", nil
+	}
+	if !imageInput {
+		return "", fmt.Errorf("image input is disabled on this proxy")
+	}
+
+	dir, err := os.MkdirTemp("", "claude-proxy-images-")
+	if err != nil {
+		return "", fmt.Errorf("failed to store image: %v", err)
+	}
+
+	for i, img := range images {
+		data, mediaType, err := loadImage(ctx, img.URL)
+		if err != nil {
+			return dir, fmt.Errorf("image %d: %v", i+1, err)
+		}
+		ext, ok := imageExtensions[mediaType]
+		if !ok {
+			return dir, fmt.Errorf("image %d: unsupported image type %q (supported: png, jpeg, gif, webp)", i+1, mediaType)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("image-%d%s", i+1, ext))
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return dir, fmt.Errorf("image %d: failed to store image: %v", i+1, err)
+		}
+		img.Path = path
+	}
+	return dir, nil
+}
+
+// loadImage returns the bytes and media type of a base64 data URI or an
+// https URL
+func loadImage(ctx context.Context, url string) ([]byte, string, error) {
+	if strings.HasPrefix(url, "data:") {
+		header, payload, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return nil, "", fmt.Errorf("data URI must be base64 encoded")
+		}
+		if base64.StdEncoding.DecodedLen(len(payload)) > maxImageBytes {
+			return nil, "", fmt.Errorf("image exceeds %d bytes", maxImageBytes)
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64 image data")
+		}
+		return data, strings.TrimSuffix(header, ";base64"), nil
+	}
+
+	if !strings.HasPrefix(url, "https://") {
+		return nil, "", fmt.Errorf("image_url must be a base64 data URI or an https URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image URL")
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to download image: HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download image: %v", err)
+	}
+	if len(data) > maxImageBytes {
+		return nil, "", fmt.Errorf("image exceeds %d bytes", maxImageBytes)
+	}
+	// Trust the bytes over the server's Content-Type header
+	return data, http.DetectContentType(data), nil
+}
+
+// imageArgs grants the CLI read access to the attachment dir so Claude can
+// open the images referenced in the prompt
+func imageArgs(imageDir string) []string {
+	if imageDir == "" {
+		return nil
+	}
+	return []string{"--add-dir", imageDir, "--allowedTools", "Read"}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestLoadImageRedirects checks an https image URL may redirect to another
+// https one, but not to plain http
+func TestLoadImageRedirects(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the http redirect target was fetched")
+	}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Write([]byte("\x89PNG\r\n\x1a\n"))
+		case "/moved":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/internal":
+			http.Redirect(w, r, plain.URL+"/image.png", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	transport := imageClient.Transport
+	imageClient.Transport = srv.Client().Transport
+	defer func() { imageClient.Transport = transport }()
+
+	_, mediaType, err := loadImage(context.Background(), srv.URL+"/moved")
+	if err != nil || mediaType != "image/png" {
+		t.Errorf("https redirect: got %q, %v", mediaType, err)
+	}
+	_, _, err = loadImage(context.Background(), srv.URL+"/internal")
+	if err == nil || !strings.Contains(err.Error(), "refusing redirect to non-https URL") {
+		t.Errorf("http redirect: err = %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Network filters, from ALLOW_CIDRS and DENY_CIDRS. A client in a denied
+// network is refused; with an allowlist, so is any client outside it.
+var (
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	// trustProxy (TRUST_PROXY) takes the client address from X-Forwarded-For
+	// or X-Real-IP, as set by a reverse proxy in front. Without one, clients
+	// could set them to anything.
+	trustProxy bool
+
+	// trustedProxies (TRUSTED_PROXIES) are the networks of the proxies in
+	// front, when there is more than one. Their X-Forwarded-For entries are
+	// skipped, and the headers only count on connections from them.
+	trustedProxies []*net.IPNet
+)
+
+// parseCIDRs reads a comma-separated list of networks, such as
+// "10.0.0.0/8,192.168.1.7". A bare address is a network of one.
+func parseCIDRs(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// clientIP is the address a request came from. With TRUST_PROXY it is the
+// right-most X-Forwarded-For entry not in TRUSTED_PROXIES, as the left-most
+// ones are whatever the client sent, or else X-Real-IP; otherwise, and if
+// neither header holds an address, the connection's peer. It is nil for Unix
+// socket clients, which have no address.
+func clientIP(r *http.Request) net.IP {
+	var peer net.IP
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = net.ParseIP(host)
+	}
+	// A peer outside TRUSTED_PROXIES reached the proxy directly, headers and
+	// all. A Unix socket peer is as trusted as the socket's permissions.
+	if !trustProxy || peer != nil && len(trustedProxies) > 0 && !inNets(peer, trustedProxies) {
+		return peer
+	}
+
+	// Each proxy appends the address it got the request from, so walk back
+	// from the end past the trusted ones. An entry that isn't an address
+	// ends the walk, as nothing before it can be relied on.
+	var client net.IP
+	entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !inNets(ip, trustedProxies) {
+			break
+		}
+	}
+	if client != nil {
+		return client
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return peer
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter refuses clients outside ALLOW_CIDRS or inside DENY_CIDRS with a
+// 403, before auth, so a refused client learns nothing about its key. The
+// unauthenticated probes (/health, /ready, /stats) stay open to monitoring,
+// and so do Unix socket clients, whom file permissions already restrict.
+func ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reloadMu.RLock()
+		allowNets, denyNets := allowNets, denyNets
+		reloadMu.RUnlock()
+		if len(allowNets) == 0 && len(denyNets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/health", "/ready", "/stats":
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if ip == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reason := ""
+		switch {
+		case inNets(ip, denyNets):
+			reason = "in DENY_CIDRS"
+		case len(allowNets) > 0 && !inNets(ip, allowNets):
+			reason = "not in ALLOW_CIDRS"
+		}
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		loggerFrom(r.Context()).Warnf("Refused client %s: %s", ip, reason)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/messages" {
+			sendAnthropicError(w, "Forbidden", http.StatusForbidden)
+		} else {
+			writeError(w, http.StatusForbidden, "permission_error", "", "Forbidden")
+		}
+	})
+}
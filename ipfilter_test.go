@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		trusted string // TRUSTED_PROXIES
+		peer    string
+		xff     []string
+		want    string
+	}{
+		{"no header", "", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"one proxy", "", "10.0.0.1:4000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed leading entry", "", "10.0.0.1:4000", []string{"6.6.6.6, 203.0.113.7"}, "203.0.113.7"},
+		{"garbage before the proxy's entry", "", "10.0.0.1:4000", []string{"nonsense, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"entries over several headers", "10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6, 203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{"all entries trusted", "10.0.0.0/8", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"spoofed trusted entry", "10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6, 203.0.113.7, nonsense, 10.0.0.2"}, "10.0.0.2"},
+		{"untrusted peer", "10.0.0.0/8", "198.51.100.9:4000", []string{"203.0.113.7"}, "198.51.100.9"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setupProxy(t)
+			trustProxy = true
+			var err error
+			if trustedProxies, err = parseCIDRs(tt.trusted); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got.String() != tt.want {
+				t.Errorf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestIPFilterSpoofedForwardedFor sends an allowed address as the first
+// X-Forwarded-For entry from a client whose real address, added by the
+// proxy, is outside ALLOW_CIDRS
+func TestIPFilterSpoofedForwardedFor(t *testing.T) {
+	setupProxy(t)
+	trustProxy = true
+	var err error
+	if allowNets, err = parseCIDRs("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	handler := ipFilter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		xff  string
+		want int
+	}{
+		{"10.1.2.3, 198.51.100.9", http.StatusForbidden},
+		{"198.51.100.9, 10.1.2.3", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		r.RemoteAddr = "127.0.0.1:4000"
+		r.Header.Set("X-Forwarded-For", tt.xff)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("X-Forwarded-For %q: status %d, want %d", tt.xff, w.Code, tt.want)
+		}
+	}
+}
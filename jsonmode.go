@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResponseFormat is OpenAI's JSON mode. The CLI can't constrain its output,
+// so JSON is asked for in the system prompt and the reply checked afterwards.
+type ResponseFormat struct {
+	Type       string `json:"type"` // text, json_object or json_schema
+	JSONSchema *struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Schema      json.RawMessage `json:"schema"`
+		Strict      *bool           `json:"strict,omitempty"`
+	} `json:"json_schema,omitempty"`
+}
+
+// errInvalidJSON means a JSON mode reply still didn't parse after a retry
+var errInvalidJSON = errors.New("the reply was not valid JSON")
+
+// jsonMode reports whether the client asked for a JSON reply
+func (req ChatRequest) jsonMode() bool {
+	return req.ResponseFormat != nil && req.ResponseFormat.Type != "text"
+}
+
+func validateResponseFormat(req ChatRequest) error {
+	f := req.ResponseFormat
+	if f == nil {
+		return nil
+	}
+	switch f.Type {
+	case "text", "json_object":
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return fmt.Errorf("response_format.json_schema.schema is required")
+		}
+		if !json.Valid(f.JSONSchema.Schema) {
+			return fmt.Errorf("response_format.json_schema.schema must be a JSON Schema object")
+		}
+	default:
+		return fmt.Errorf("response_format.type must be text, json_object or json_schema")
+	}
+	return nil
+}
+
+// responseFormatPrompt tells Claude to answer in JSON, for the system
+// prompt. It is empty unless JSON mode is on.
+func responseFormatPrompt(req ChatRequest) string {
+	if !req.jsonMode() {
+		return ""
+	}
+	const bare = "Do not wrap it in a Markdown code block or write anything before or after it."
+	if req.ResponseFormat.Type == "json_object" {
+		return "Reply with a single valid JSON object and nothing else. " + bare
+	}
+	s := req.ResponseFormat.JSONSchema
+	var b strings.Builder
+	b.WriteString("Reply with a single valid JSON value that conforms to the JSON Schema below, and nothing else. " + bare)
+	if s.Description != "" {
+		fmt.Fprintf(&b, "\n\n%s", s.Description)
+	}
+	fmt.Fprintf(&b, "\n\n<schema name=%q>\n%s\n</schema>", s.Name, s.Schema)
+	return b.String()
+}
+
+// extractJSON returns the JSON in a reply, without the code fence Claude
+// sometimes puts around it anyway. ok is false if the reply isn't valid JSON,
+// or for json_object, isn't an object. The schema itself is not checked.
+func (req ChatRequest) extractJSON(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") && len(text) >= 6 {
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "```"), "```")
+		// The fence may name a language, "json" as a rule
+		if i := strings.IndexByte(text, '\n'); i >= 0 && !strings.ContainsAny(text[:i], "{[\"") {
+			text = text[i+1:]
+		}
+		text = strings.TrimSpace(text)
+	}
+	if !json.Valid([]byte(text)) {
+		return text, false
+	}
+	if req.ResponseFormat.Type == "json_object" && !strings.HasPrefix(text, "{") {
+		return text, false
+	}
+	return text, true
+}
+
+// checkJSON validates a JSON mode reply, returning the JSON to send. Replies
+// that call tools are left alone: their arguments are JSON already.
+func (run *claudeRun) checkJSON(text string) (string, error) {
+	if run.Req.usesTools() {
+		if _, calls := parseToolCalls(text); len(calls) > 0 {
+			return text, nil
+		}
+	}
+	if clean, ok := run.Req.extractJSON(text); ok {
+		return clean, nil
+	}
+	return text, errInvalidJSON
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pingInterval is how often an SSE comment is sent while the CLI runs, from
+// SSE_PING_INTERVAL; 0 turns pings off
+var pingInterval = 15 * time.Second
+
+// pinger keeps a streaming response alive while the CLI runs by writing SSE
+// comment lines, which clients ignore, so proxies in between don't close a
+// connection that has gone quiet (say, before the first token). Pings start
+// once the CLI process is running, not while the request waits for a slot,
+// so a full queue can still be answered with a plain 429.
+type pinger struct {
+	mu      *sync.Mutex // guards writes to the response; shared with the handler
+	w       io.Writer
+	flusher http.Flusher
+
+	once   sync.Once
+	quit   chan struct{}
+	done   chan struct{}
+	pinged bool // guarded by mu
+}
+
+func newPinger(w io.Writer, flusher http.Flusher, mu *sync.Mutex) *pinger {
+	return &pinger{mu: mu, w: w, flusher: flusher, quit: make(chan struct{}), done: make(chan struct{})}
+}
+
+// start begins pinging. It is safe to call repeatedly and concurrently, as
+// every CLI run of a request does.
+func (p *pinger) start() {
+	if pingInterval <= 0 {
+		return
+	}
+	p.once.Do(func() {
+		go func() {
+			defer close(p.done)
+			ticker := time.NewTicker(pingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.quit:
+					return
+				case <-ticker.C:
+					p.mu.Lock()
+					io.WriteString(p.w, ": ping\n\n")
+					p.flusher.Flush()
+					p.pinged = true
+					p.mu.Unlock()
+				}
+			}
+		}()
+	})
+}
+
+// stderr writes a line the CLI printed to stderr as an SSE comment, for
+// X-Proxy-Debug streams. Clients skip it like a ping, but it shows in the raw
+// stream. Credentials are redacted; paths, unlike in error messages, are not.
+func (p *pinger) stderr(line string) {
+	line = secretPattern.ReplaceAllString(line, "[redacted]")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, ": stderr: %s\n\n", line)
+	p.flusher.Flush()
+	p.pinged = true
+}
+
+// stop ends pinging and waits until no ping can be written any more. It
+// reports whether any ping went out, in which case the response status is
+// already committed and errors can only be sent as SSE events.
+func (p *pinger) stop() bool {
+	started := true
+	p.once.Do(func() { started = false })
+	if started {
+		close(p.quit)
+		<-p.done
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pinged
+}
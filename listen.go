@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// listen opens the proxy's listener: the Unix socket at socketPath if set,
+// otherwise TCP on port. It also returns the address for the startup log.
+func listen(port, socketPath string, socketMode os.FileMode) (net.Listener, string, error) {
+	if socketPath == "" {
+		ln, err := net.Listen("tcp", ":"+port)
+		return ln, ":" + port, err
+	}
+
+	// A socket left behind by a crashed run would make Listen fail, but one
+	// that still answers belongs to a live process and must be left alone
+	if fi, err := os.Lstat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("%s is in use by another process", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, "", err
+	}
+	// Closing the listener on shutdown removes the socket file again
+	if err := os.Chmod(socketPath, socketMode); err != nil {
+		ln.Close()
+		return nil, "", err
+	}
+	return ln, "unix:" + socketPath, nil
+}
+
+// maxConnections (MAX_CONNECTIONS) caps the client connections open at once,
+// 0 for no limit
+var maxConnections int
+
+// limitListener holds open connections to maxConnections. Past it, Accept
+// waits for one to close, so further clients queue in the kernel's backlog
+// instead of each costing the proxy a goroutine and buffers.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, n int) *limitListener {
+	return &limitListener{Listener: ln, slots: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: sync.OnceFunc(func() { <-l.slots })}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its slot when closed, however often that happens
+type limitConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger writes log lines either as classic text (the default) or, with
+// LOG_FORMAT=json, as one JSON object per line for aggregators like Loki.
+// Fields attached with With only appear in JSON output, so the text format
+// stays exactly what log.Printf would print.
+type Logger struct {
+	fields []interface{} // alternating key, value
+}
+
+var (
+	logJSON bool
+	logMu   sync.Mutex
+	logger  = &Logger{}
+)
+
+// logLevels orders the levels; lines below logLevel (LOG_LEVEL) are dropped.
+// Prompt and response text is only ever logged at trace.
+var logLevels = map[string]int{"trace": 0, "debug": 1, "info": 2, "warn": 3, "error": 4, "fatal": 5}
+
+var logLevel = logLevels["info"]
+
+// With returns a logger that adds the given key/value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) field(key string) interface{} {
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		if l.fields[i] == key {
+			return l.fields[i+1]
+		}
+	}
+	return nil
+}
+
+type loggerKey struct{}
+
+type startKey struct{}
+
+// requestStart is when logRequests began serving the request, or now outside
+// of one
+func requestStart(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(startKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// withLogger attaches a request's logger to its context
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the request's logger, or the global one outside a request
+func loggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// requestID reuses a client-supplied X-Request-Id when it is sane enough to
+// put in logs, and otherwise makes a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		ok := true
+		for _, c := range id {
+			if c <= ' ' || c > '~' {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return id
+		}
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.output("trace", format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.output("debug", format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.output("info", format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.output("warn", format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.output("error", format, args...)
+}
+
+// Fatalf logs and exits, like log.Fatalf
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.output("fatal", format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) output(level, format string, args ...interface{}) {
+	if logLevels[level] < logLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !logJSON {
+		switch level {
+		case "warn":
+			msg = "WARNING: " + msg
+		case "debug", "trace":
+			msg = strings.ToUpper(level) + ": " + msg
+		}
+		// The request ID is the one field worth keeping in text logs, so
+		// interleaved lines from concurrent requests can be told apart
+		if id, ok := l.field("request_id").(string); ok {
+			msg = "[" + id + "] " + msg
+		}
+		log.Print(msg)
+		return
+	}
+
+	// Build the object by hand so keys keep a stable, readable order
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, level)
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, msg)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		key, ok := l.fields[i].(string)
+		if !ok {
+			continue
+		}
+		b.WriteByte(',')
+		writeJSONValue(&b, key)
+		b.WriteByte(':')
+		writeJSONValue(&b, l.fields[i+1])
+	}
+	b.WriteString("}\n")
+
+	logMu.Lock()
+	os.Stderr.Write(b.Bytes())
+	logMu.Unlock()
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		out.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	b.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+}
+
+// statusRecorder remembers the status a handler wrote so it can be logged
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64 // body bytes written, for ACCESS_LOG
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming working through the wrapper
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logRequests gives every request an ID, returned in X-Request-Id and
+// attached to all of its log lines, and logs one line per finished request
+// with its status and duration
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-Id", id)
+		reqLog := logger.With("request_id", id)
+		if key := requestKey(r); key != "" {
+			reqLog = reqLog.With("key", keyLabel(key))
+		}
+		if ip := clientIP(r); ip != nil {
+			reqLog = reqLog.With("client", ip.String())
+		}
+		r = r.WithContext(context.WithValue(withLogger(r.Context(), reqLog), startKey{}, start))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+			if r.Context().Err() != nil {
+				rec.status = 499 // nginx's "client closed request", nothing was sent
+			}
+		}
+		if access != nil {
+			access.record(r, rec, start)
+		}
+		// Health probes arrive every few seconds and would drown everything else
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" || r.URL.Path == "/stats" {
+			return
+		}
+		elapsed := time.Since(start)
+		reqLog.With("status", rec.status, "duration_ms", elapsed.Milliseconds()).
+			Infof("%s %s -> %d in %v", r.Method, r.URL.Path, rec.status, elapsed)
+	})
+}
@@ -4,7 +4,7 @@
 // instead of requiring separate API credits.
 //
 // Usage:
-//   PROXY_API_KEY=your-secret go run main.go
+//   PROXY_API_KEY=your-secret go run .
 //
 // Then configure your app:
 //   Endpoint: http://localhost:8080/v1/chat/completions
@@ -14,80 +14,439 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // OpenAI-compatible request/response structures
 type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	Stream    bool      `json:"stream"`
+	MaxTokens *int      `json:"max_tokens,omitempty"`
+	Stop      StopList  `json:"stop,omitempty"`
+
+	// Accepted but ignored: the CLI has no sampling options, so replies are
+	// sampled as it sees fit. Aider and others send temperature 0 regardless.
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+
+	// MaxCompletionTokens is OpenAI's newer name for max_tokens, which
+	// updated SDKs send instead. It wins if both are set.
+	MaxCompletionTokens *int `json:"max_completion_tokens,omitempty"`
+
+	// N asks for several independent completions, each its own CLI run
+	N *int `json:"n,omitempty"`
+
+	// The CLI can't produce token logprobs, so asking for them is a 400
+	// unless IGNORE_LOGPROBS is set
+	Logprobs    *bool `json:"logprobs,omitempty"`
+	TopLogprobs *int  `json:"top_logprobs,omitempty"`
+
+	// Accepted for compatibility but ignored: Claude has no repetition
+	// penalties. Frameworks like LangChain send them on every request.
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+
+	// Also ignored: the CLI can't bias tokens, and its tokenizer isn't the
+	// one the client's token IDs come from
+	LogitBias map[string]float64 `json:"logit_bias,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	// The CLI can't seed sampling, so a seed only keys system_fingerprint;
+	// seeded requests are no more deterministic than any other
+	Seed *int `json:"seed,omitempty"`
+
+	// Client-defined tools, described to Claude in the system prompt
+	Tools      []Tool          `json:"tools,omitempty"`
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+
+	// User identifies the client's end user, for logs and USER_RATE_LIMIT_RPM
+	User string `json:"user,omitempty"`
+
+	// ReasoningEffort picks a model tier through REASONING_EFFORT_MODELS
+	// when no known model is named (or always, with MAP_REASONING_EFFORT)
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+
+	// ResponseFormat asks for JSON; see jsonmode.go
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	modelFromHeader bool // Model was set by X-Claude-Model; see useModelHeader
+}
+
+// useModelHeader lets an X-Claude-Model header override the body's model, for
+// clients that hard-code one but can add headers. The header's value is
+// resolved just like the body's would be.
+func (req *ChatRequest) useModelHeader(header string) {
+	if header = strings.TrimSpace(header); header != "" {
+		req.Model = header
+		req.modelFromHeader = true
+	}
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// maxTokens is the reply's token limit, or 0 for none
+func (req ChatRequest) maxTokens() int {
+	if req.MaxTokens == nil {
+		return 0
+	}
+	return *req.MaxTokens
+}
+
+// includeUsage reports whether a stream should end with a usage chunk
+func (req ChatRequest) includeUsage() bool {
+	return req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+}
+
+// StopList holds the client's stop sequences. OpenAI accepts either a single
+// string or an array of strings.
+type StopList []string
+
+func (s *StopList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		if one != "" {
+			*s = StopList{one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = nil
+	for _, seq := range many {
+		if seq != "" {
+			*s = append(*s, seq)
+		}
+	}
+	return nil
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string         `json:"role"`
+	Content MessageContent `json:"content"`
+
+	// Tool calls made by an assistant, and the call a role "tool" message
+	// answers
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+
+	// Name is the function a legacy role "function" message answers
+	Name string `json:"name,omitempty"`
+}
+
+// knownRoles are the message roles the proxy understands; anything else is
+// rejected rather than silently dropped from the prompt
+var knownRoles = map[string]bool{
+	"system":    true,
+	"developer": true, // OpenAI's newer name for system
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+	"function":  true, // the deprecated form of tool
+}
+
+// MessageContent is a message body. Clients send it either as a plain string
+// or as an array of typed parts; text parts are joined into Text and image
+// parts are collected into Images.
+type MessageContent struct {
+	Text   string
+	Images []*ImageAttachment
+	// CacheHint is set if any part carried Anthropic's cache_control, which
+	// the CLI has no way to take: it caches prompts on its own
+	CacheHint bool
+}
+
+type ContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+	// Anthropic-style image block source
+	Source *struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source,omitempty"`
+	CacheControl json.RawMessage `json:"cache_control,omitempty"`
+}
+
+// ImageAttachment is an image_url part. Path is filled in once the image has
+// been written to disk for the CLI to read.
+type ImageAttachment struct {
+	URL  string
+	Path string
+}
+
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		c.Text = text
+		return nil
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+	var texts []string
+	for _, part := range parts {
+		if len(part.CacheControl) > 0 {
+			c.CacheHint = true
+		}
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL == nil || part.ImageURL.URL == "" {
+				return fmt.Errorf("image_url part is missing a url")
+			}
+			c.Images = append(c.Images, &ImageAttachment{URL: part.ImageURL.URL})
+		case "image":
+			switch {
+			case part.Source != nil && part.Source.Type == "base64":
+				url := "data:" + part.Source.MediaType + ";base64," + part.Source.Data
+				c.Images = append(c.Images, &ImageAttachment{URL: url})
+			case part.Source != nil && part.Source.Type == "url":
+				c.Images = append(c.Images, &ImageAttachment{URL: part.Source.URL})
+			default:
+				return fmt.Errorf("image block needs a base64 or url source")
+			}
+		default:
+			logger.Warnf("Skipping unsupported content part type %q", part.Type)
+		}
+	}
+	c.Text = strings.Join(texts, "\n")
+	return nil
+}
+
+// PromptText is the text sent to the CLI for this message, with a reference
+// to each materialized image so Claude can open it with its Read tool
+func (c MessageContent) PromptText() string {
+	var b strings.Builder
+	b.WriteString(c.Text)
+	for _, img := range c.Images {
+		if img.Path == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[Attached image: %s]", img.Path)
+	}
+	return b.String()
+}
+
+// MarshalJSON always emits the plain string form, which every client accepts
+func (c MessageContent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Text)
 }
 
+// ChatResponse is both a completion and, with Delta choices, a stream chunk.
+// Fields OpenAI always sends are always present, null when there is nothing
+// to report, since strict clients fail on missing keys.
 type ChatResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage"`
+	ID                string   `json:"id"`
+	Object            string   `json:"object"`
+	Created           int64    `json:"created"`
+	Model             string   `json:"model"`
+	SystemFingerprint *string  `json:"system_fingerprint"`
+	Choices           []Choice `json:"choices"`
+	Usage             *Usage   `json:"usage,omitempty"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message,omitempty"`
-	Delta        *Delta  `json:"delta,omitempty"`
-	FinishReason string  `json:"finish_reason,omitempty"`
+	Index        int      `json:"index"`
+	Message      *Message `json:"message,omitempty"`
+	Delta        *Delta   `json:"delta,omitempty"`
+	Logprobs     *string  `json:"logprobs"`      // always null
+	FinishReason *string  `json:"finish_reason"` // null until a stream's last chunk
 }
 
 type Delta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role             string     `json:"role,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"` // INCLUDE_THINKING only
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// PromptTokensDetails says how many prompt tokens were read from the
+	// prompt cache. It is only there when the numbers are the CLI's own.
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
+// ErrorResponse is OpenAI's error shape. param and code are always present,
+// null when unset, as the official SDKs expect.
 type ErrorResponse struct {
 	Error struct {
-		Message string `json:"message"`
-		Type    string `json:"type"`
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Param   *string `json:"param"`
+		Code    *string `json:"code"`
 	} `json:"error"`
 }
 
+// OpenAI-compatible model listing structures
+type ModelList struct {
+	Object string      `json:"object"`
+	Data   []ModelInfo `json:"data"`
+}
+
+type ModelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
 // Claude CLI streaming JSON structures
+// (also the shape of `--output-format json` output, which is a single
+// result message)
 type ClaudeStreamMessage struct {
 	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
 	Message struct {
 		Content []struct {
-			Type string `json:"text"`
+			Type string `json:"type"`
 			Text string `json:"text"`
 		} `json:"content"`
 	} `json:"message"`
-	Result string `json:"result"`
+	Result    string    `json:"result"`
+	IsError   bool      `json:"is_error"`
+	Usage     *cliUsage `json:"usage"`
+	SessionID string    `json:"session_id"`
 }
 
 var (
-	apiKey       string
-	defaultModel string
+	apiKey          string
+	defaultModel    string
+	modelAliases    map[string]string       // client model name -> CLI model, from MODEL_ALIASES
+	modelDefaults   map[string]modelDefault // base model -> defaults, from MODEL_DEFAULTS
+	allowedModels   map[string]bool         // ALLOWED_MODELS: base models clients may use; nil allows all
+	modelFallbacks  map[string][]string     // base model -> models to try instead, from MODEL_FALLBACK
+	effortModels    map[string]string       // reasoning_effort -> base model, from REASONING_EFFORT_MODELS
+	mapEffort       bool                    // MAP_REASONING_EFFORT: reasoning_effort beats the body's model
+	requestTimeout  time.Duration
+	imageInput      bool
+	maxBodyBytes    int64 // MAX_BODY_BYTES: larger requests get a 413
+	maxPromptChars  int   // MAX_PROMPT_CHARS: longer assembled prompts get a 400; 0 is no limit
+	maxPromptTokens int   // MAX_PROMPT_TOKENS: the same, in estimated tokens
+	debugMode       bool  // DEBUG: longer CLI error detail in responses
+	ignoreLogprobs  bool  // IGNORE_LOGPROBS: accept logprobs requests and return none
+	includeThinking bool  // INCLUDE_THINKING: stream extended thinking as reasoning_content
+	trimOutput      bool  // TRIM_OUTPUT: strip whitespace around replies
+	// forceStreaming and forceNonStreaming override every chat completion
+	// request's stream flag, from FORCE_STREAMING and FORCE_NON_STREAMING
+	forceStreaming    bool
+	forceNonStreaming bool
+	// outputFormat is the CLI's --output-format for non-streaming requests,
+	// from CLAUDE_OUTPUT_FORMAT: "json" for the reply with its real usage and
+	// session, or "text" for the bare reply
+	outputFormat = "json"
+	// proxySystemPrompt goes ahead of every request's system prompt, from
+	// PROXY_SYSTEM_PROMPT or PROXY_SYSTEM_PROMPT_FILE
+	proxySystemPrompt string
+	// userPromptPrefix and userPromptSuffix wrap every request's user
+	// prompt, from USER_PROMPT_PREFIX and USER_PROMPT_SUFFIX
+	userPromptPrefix string
+	userPromptSuffix string
+	corsOrigin       string
+	startedAt        = time.Now()
+
+	// cliSlots bounds how many claude processes run at once; requests wait
+	// up to queueTimeout for a free slot
+	cliSlots     chan struct{}
+	queueTimeout time.Duration
+
+	// cliMaxRetries is how many times a transient CLI failure is retried
+	cliMaxRetries int
+
+	// maxChoices caps n, since every choice is a separate CLI run
+	maxChoices int
+)
+
+// Shutdown state: activeRequests counts requests being served, and
+// terminateCtx is cancelled once the drain deadline passes so any CLI
+// processes still running are killed
+var (
+	activeRequests  int64
+	shutdownTimeout time.Duration
+
+	terminateCtx, terminateCLI = context.WithCancel(context.Background())
+)
+
+// Server limits. READ_HEADER_TIMEOUT is kept tight so slow clients can't
+// hold connections open header byte by header byte; READ_TIMEOUT covers the
+// body as well. WRITE_TIMEOUT is off by default: it counts from the end of
+// the request's headers, so it would cut off any reply that takes longer,
+// and SSE streams clear it, since they last as long as the CLI run.
+// MAX_HEADER_BYTES bounds the headers a client can make the proxy buffer.
+var (
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
 )
 
+// errBusy means every CLI slot stayed taken for the whole queue timeout
+var errBusy = errors.New("too many concurrent requests")
+
+// errModelNotAllowed means the request's model is outside ALLOWED_MODELS
+var errModelNotAllowed = errors.New("model not allowed")
+
+// errPromptTooLong means the prompt is over MAX_PROMPT_CHARS or
+// MAX_PROMPT_TOKENS
+var errPromptTooLong = errors.New("prompt too long")
+
+// modelCatalog is the canonical table of models the proxy understands.
+// normalizeModel and /v1/models both read it so they never drift apart.
+var modelCatalog = []struct {
+	Base    string
+	Aliases []string
+}{
+	{"haiku", []string{"claude-haiku-4-5", "claude-haiku-4-5-20241022"}},
+	{"sonnet", []string{"claude-sonnet-4-5", "claude-sonnet-4-5-20241022"}},
+	{"opus", []string{"claude-opus-4-5", "claude-opus-4-5-20251101"}},
+}
+
 // System prompt reinforcement for transcription-like tasks
 // This helps prevent Claude from breaking character and responding conversationally
 const systemPromptReinforcement = `
@@ -178,383 +537,2863 @@ func wrapShortTranscript(userPrompt string) string {
 	return userPrompt
 }
 
-// normalizeModel extracts the base model name (haiku, sonnet, opus)
-func normalizeModel(m string) string {
-	m = strings.ToLower(strings.TrimSpace(m))
-	// Strip common prefixes
-	m = strings.TrimPrefix(m, "claude-")
-	m = strings.TrimPrefix(m, "claude_")
-	// Handle versioned names like "haiku-4-5" -> "haiku"
-	for _, base := range []string{"haiku", "sonnet", "opus"} {
-		if strings.HasPrefix(m, base) {
-			return base
-		}
-	}
-	// If not recognized, return as-is (let claude CLI handle it)
-	if m == "" {
-		return "sonnet" // default
-	}
-	return m
+// Preamble for multi-turn conversations. The CLI only takes a single prompt on
+// stdin, so prior turns are replayed as a tagged transcript the model can
+// tell apart from the turn it is meant to answer.
+const transcriptPreamble = `The conversation so far is shown below, one turn per tag. Reply to the final turn as the assistant. Do not repeat the tags or write turns for anyone else.`
+
+// historyMode is how prior turns reach the CLI, from HISTORY_MODE:
+// "transcript" replays them as a role-tagged transcript, "full" inlines them
+// the way early versions of the proxy did, and "last-user-only" sends just
+// the final user message, for clients that manage their own context
+var historyMode = "transcript"
+
+// systemPolicy is what happens to system messages that come after the
+// conversation has started, from SYSTEM_MESSAGE_POLICY. Leading ones always
+// form the system prompt. "inline" keeps later ones where they are (as
+// <system> turns in the transcript; the other renderings have no turns, so
+// they join the system prompt there), "hoist" moves them all into the system
+// prompt, and "fold" merges each into the next user message, or the last one
+// if none follows, so every rendering keeps them next to the turn they were
+// meant for.
+var systemPolicy = "inline"
+
+// turn is one speaker's contribution after consecutive messages from the same
+// role have been merged
+type turn struct {
+	Role    string
+	Content string
 }
 
-func main() {
-	apiKey = os.Getenv("PROXY_API_KEY")
-	if apiKey == "" {
-		log.Fatal("PROXY_API_KEY environment variable required")
-	}
-
-	defaultModel = os.Getenv("CLAUDE_MODEL")
-	if defaultModel == "" {
-		defaultModel = "sonnet" // Default to sonnet
+// buildPrompts splits request messages into the CLI system prompt and the
+// text piped to stdin. System messages before the first user/assistant turn
+// form the system prompt; system messages that show up mid-conversation stay
+// in place as <system> turns so their position is not lost. Assistant tool
+// calls and tool/function results are written out as tagged blocks.
+// Consecutive messages from the same role are merged into one turn.
+// Messages must already have passed validateRoles. HISTORY_MODE can swap the
+// transcript for one of the other renderings, and SYSTEM_MESSAGE_POLICY
+// moves mid-conversation system messages first.
+func buildPrompts(messages []Message) (string, string) {
+	messages = placeSystemMessages(messages)
+	switch historyMode {
+	case "full":
+		return buildInlinePrompts(messages)
+	case "last-user-only":
+		return buildLastUserPrompts(messages)
 	}
-	defaultModel = normalizeModel(defaultModel)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	var system []string
+	var turns []turn
+	for _, msg := range messages {
+		role, content := msg.Role, msg.Content.PromptText()
+		switch role {
+		case "system", "developer":
+			role = "system"
+			if len(turns) == 0 {
+				system = append(system, msg.Content.Text)
+				continue
+			}
+		case "assistant":
+			content = joinPrompts(content, formatToolCalls(msg.ToolCalls))
+		case "tool", "function":
+			role, content = "tool", formatToolResult(msg)
+		}
+		if n := len(turns); n > 0 && turns[n-1].Role == role {
+			turns[n-1].Content += "\n\n" + content
+			continue
+		}
+		turns = append(turns, turn{Role: role, Content: content})
 	}
-
-	http.HandleFunc("/v1/chat/completions", handleChat)
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok"))
-	})
-
-	log.Printf("Claude Code proxy starting on :%s (default model: %s, streaming: enabled)", port, defaultModel)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	return strings.Join(system, "\n\n"), formatTranscript(turns)
 }
 
-func handleChat(w http.ResponseWriter, r *http.Request) {
-	// Verify API key
-	auth := r.Header.Get("Authorization")
-	if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != apiKey {
-		w.Header().Set("Content-Type", "application/json")
-		sendError(w, "Invalid API key", http.StatusUnauthorized)
-		return
+// placeSystemMessages applies SYSTEM_MESSAGE_POLICY to the system messages
+// that follow the first user, assistant or tool message. The caller's slice
+// is left as it was.
+func placeSystemMessages(messages []Message) []Message {
+	if systemPolicy == "inline" {
+		return messages
 	}
-
-	if r.Method != "POST" {
-		w.Header().Set("Content-Type", "application/json")
-		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	var leading, rest []Message
+	var pending []string // fold: system text waiting for the next user message
+	for _, msg := range messages {
+		system := msg.Role == "system" || msg.Role == "developer"
+		switch {
+		case system && (len(rest) == 0 || systemPolicy == "hoist"):
+			leading = append(leading, msg)
+		case system:
+			pending = append(pending, msg.Content.Text)
+		case msg.Role == "user" && len(pending) > 0:
+			msg.Content.Text = joinPrompts(append(pending, msg.Content.Text)...)
+			pending = nil
+			rest = append(rest, msg)
+		default:
+			rest = append(rest, msg)
+		}
 	}
-
-	// Parse request
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		sendError(w, "Failed to read request", http.StatusBadRequest)
-		return
+	// Nothing followed them, so they go to the last user message instead
+	if len(pending) > 0 {
+		for i := len(rest) - 1; i >= 0; i-- {
+			if rest[i].Role == "user" {
+				rest[i].Content.Text = joinPrompts(append([]string{rest[i].Content.Text}, pending...)...)
+				pending = nil
+				break
+			}
+		}
 	}
-
-	var req ChatRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		sendError(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	// Without any user message to take them, they join the system prompt
+	for _, text := range pending {
+		leading = append(leading, Message{Role: "system", Content: MessageContent{Text: text}})
 	}
+	return append(leading, rest...)
+}
 
-	// Log incoming messages for debugging
-	log.Printf("=== INCOMING REQUEST ===")
-	log.Printf("Model requested: %s", req.Model)
-	log.Printf("Stream: %v", req.Stream)
-	log.Printf("Messages count: %d", len(req.Messages))
-	for i, msg := range req.Messages {
-		log.Printf("  [%d] role=%s, content_len=%d", i, msg.Role, len(msg.Content))
+// buildInlinePrompts is HISTORY_MODE=full: every system message joins the
+// system prompt, and the rest is written out in order with earlier assistant
+// replies marked as such
+func buildInlinePrompts(messages []Message) (string, string) {
+	var system []string
+	var b strings.Builder
+	for _, msg := range messages {
+		switch msg.Role {
+		case "system", "developer":
+			system = append(system, msg.Content.Text)
+		case "assistant":
+			fmt.Fprintf(&b, "[Previous response: %s]\n", joinPrompts(msg.Content.PromptText(), formatToolCalls(msg.ToolCalls)))
+		case "tool", "function":
+			b.WriteString(formatToolResult(msg) + "\n")
+		default:
+			b.WriteString(msg.Content.PromptText() + "\n")
+		}
 	}
+	return strings.Join(system, "\n\n"), strings.TrimSuffix(b.String(), "\n")
+}
 
-	// Separate system prompt from conversation messages
-	var systemPrompt strings.Builder
-	var userPrompt strings.Builder
-
-	for _, msg := range req.Messages {
+// buildLastUserPrompts is HISTORY_MODE=last-user-only: the system prompt as
+// usual, and nothing but the final user message
+func buildLastUserPrompts(messages []Message) (string, string) {
+	var system []string
+	last := ""
+	for _, msg := range messages {
 		switch msg.Role {
-		case "system":
-			if systemPrompt.Len() > 0 {
-				systemPrompt.WriteString("\n\n")
-			}
-			systemPrompt.WriteString(msg.Content)
+		case "system", "developer":
+			system = append(system, msg.Content.Text)
 		case "user":
-			userPrompt.WriteString(msg.Content)
-			userPrompt.WriteString("\n")
-		case "assistant":
-			userPrompt.WriteString("[Previous response: ")
-			userPrompt.WriteString(msg.Content)
-			userPrompt.WriteString("]\n")
+			last = msg.Content.PromptText()
 		}
 	}
+	return strings.Join(system, "\n\n"), last
+}
 
-	log.Printf("System prompt: %d chars, User prompt: %d chars", systemPrompt.Len(), userPrompt.Len())
-
-	// Determine model: use request model if provided, otherwise default
-	requestModel := normalizeModel(req.Model)
-	if requestModel == "" {
-		requestModel = defaultModel
+// validateRoles rejects messages with a role the proxy doesn't know, which
+// would otherwise have to be dropped or guessed at
+func validateRoles(messages []Message) error {
+	for i, msg := range messages {
+		if !knownRoles[msg.Role] {
+			return fmt.Errorf("messages[%d]: unsupported role %q", i, msg.Role)
+		}
 	}
+	return nil
+}
 
-	if req.Stream {
-		handleStreamingRequest(w, systemPrompt.String(), userPrompt.String(), requestModel)
-	} else {
-		handleNonStreamingRequest(w, systemPrompt.String(), userPrompt.String(), requestModel)
+// hasUserContent reports whether any user message has text or an image;
+// without one the CLI would be run with nothing to answer
+func hasUserContent(messages []Message) bool {
+	for _, msg := range messages {
+		if msg.Role == "user" && (strings.TrimSpace(msg.Content.Text) != "" || len(msg.Content.Images) > 0) {
+			return true
+		}
 	}
+	return false
 }
 
-func handleNonStreamingRequest(w http.ResponseWriter, systemPrompt string, userPrompt string, model string) {
-	w.Header().Set("Content-Type", "application/json")
+// wrapUserPrompt puts USER_PROMPT_PREFIX and USER_PROMPT_SUFFIX around the
+// assembled user prompt, history and all
+func wrapUserPrompt(prompt string) string {
+	return joinPrompts(userPromptPrefix, prompt, userPromptSuffix)
+}
 
-	// Check if this is a transcription task and add reinforcement
-	effectiveSystemPrompt := systemPrompt
-	effectiveUserPrompt := userPrompt
-	isTranscription := isTranscriptionTask(systemPrompt)
-	if isTranscription && systemPrompt != "" {
-		effectiveSystemPrompt = systemPrompt + systemPromptReinforcement
-		// Wrap short transcripts to prevent Claude from treating them as conversation
-		effectiveUserPrompt = wrapShortTranscript(userPrompt)
-		if len(userPrompt) < 200 {
-			log.Printf("Detected short transcription (%d chars), adding wrapper", len(userPrompt))
+// joinPrompts joins the non-empty prompts with blank lines between them
+func joinPrompts(prompts ...string) string {
+	var parts []string
+	for _, p := range prompts {
+		if p != "" {
+			parts = append(parts, p)
 		}
-		log.Printf("Detected transcription task, adding reinforcement")
 	}
+	return strings.Join(parts, "\n\n")
+}
 
-	// Build command with proper system prompt separation
-	args := []string{"--print", "--model", model}
-	if effectiveSystemPrompt != "" {
-		args = append(args, "--system-prompt", effectiveSystemPrompt)
+// formatTranscript renders turns for stdin. A lone user turn is passed
+// through untouched so single-shot prompts look exactly as the client sent
+// them.
+func formatTranscript(turns []turn) string {
+	if len(turns) == 1 && turns[0].Role == "user" {
+		return turns[0].Content
 	}
+	var b strings.Builder
+	b.WriteString(transcriptPreamble)
+	for _, t := range turns {
+		fmt.Fprintf(&b, "\n\n<%s>\n%s\n</%s>", t.Role, t.Content, t.Role)
+	}
+	return b.String()
+}
 
-	cmd := exec.Command("claude", args...)
-	cmd.Stdin = strings.NewReader(effectiveUserPrompt)
-
-	log.Printf("Processing request (model: %s, system: %d chars, user: %d chars, transcription: %v)", model, len(effectiveSystemPrompt), len(userPrompt), isTranscription)
-	start := time.Now()
+// envDuration reads a duration from the environment. Plain integers are
+// treated as seconds so "120" and "120s" mean the same thing.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return fallback
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return d
+}
 
-	output, err := cmd.Output()
+// envInt reads an integer from the environment
+func envInt(name string, fallback int) int {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		log.Printf("Claude CLI error: %v", err)
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			log.Printf("Stderr: %s", string(exitErr.Stderr))
-		}
-		sendError(w, "Claude CLI failed: "+err.Error(), http.StatusInternalServerError)
-		return
+		logger.Fatalf("Invalid %s %q: %v", name, v, err)
 	}
+	return n
+}
 
-	elapsed := time.Since(start)
-	response := strings.TrimSpace(string(output))
-	log.Printf("Response received in %v (%d chars)", elapsed, len(response))
+// acquireSlot waits for a free CLI slot. It gives up with errBusy after
+// queueTimeout, with errQueueFull at once if MAX_QUEUE_DEPTH requests are
+// already waiting, or with ctx's error if the request ends first. The returned
+// func releases the slot and must be called once the CLI has exited.
+func acquireSlot(ctx context.Context) (func(), error) {
+	release := func() { <-cliSlots }
+	select {
+	case cliSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
 
-	// Log if we detect breakage (Claude broke character)
-	if isTranscription && detectBreakage(response) {
-		log.Printf("WARNING: Detected possible breakage in transcription response")
-		log.Printf("User prompt was: %s", userPrompt)
-		log.Printf("Response was: %.500s", response)
+	depth := atomic.AddInt64(&queueDepth, 1)
+	defer atomic.AddInt64(&queueDepth, -1)
+	if maxQueueDepth > 0 && depth > maxQueueDepth {
+		loggerFrom(ctx).Warnf("Request queue full (%d waiting), rejecting", maxQueueDepth)
+		return nil, errQueueFull
 	}
 
-	totalPrompt := len(systemPrompt) + len(userPrompt)
-	resp := ChatResponse{
-		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   model,
-		Choices: []Choice{
-			{
-				Index: 0,
-				Message: Message{
-					Role:    "assistant",
-					Content: response,
-				},
-				FinishReason: "stop",
-			},
-		},
-		Usage: Usage{
-			PromptTokens:     totalPrompt / 4,
-			CompletionTokens: len(response) / 4,
-			TotalTokens:      (totalPrompt + len(response)) / 4,
-		},
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case cliSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+}
 
-	json.NewEncoder(w).Encode(resp)
+// withShutdown derives a context that is also cancelled when shutdown gives up
+// draining, so CLI processes bound to it are killed rather than orphaned
+func withShutdown(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(terminateCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
 }
 
-func handleStreamingRequest(w http.ResponseWriter, systemPrompt string, userPrompt string, model string) {
-	// Set SSE headers
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// transientErrors are signs that a failed CLI run may well succeed if
+// simply run again: API overload, network blips and auth token refreshes.
+// Anything else, such as a prompt the API rejects, fails straight away.
+var transientErrors = []string{
+	"overloaded",
+	"rate limit",
+	"rate_limit",
+	"api error: 5",
+	"internal server error",
+	"timed out",
+	"timeout",
+	"econnreset",
+	"econnrefused",
+	"etimedout",
+	"socket hang up",
+	"network",
+	"oauth",
+	"token has expired",
+	"try again",
+}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
+// shouldRetry reports whether a failed CLI attempt is worth repeating, and if
+// so waits out an exponential backoff first (500ms, 1s, 2s, ...)
+func shouldRetry(ctx context.Context, run *claudeRun, attempt int, err error) bool {
+	if attempt >= cliMaxRetries || ctx.Err() != nil {
+		return false
 	}
-
-	// Check if this is a transcription task and add reinforcement
-	effectiveSystemPrompt := systemPrompt
-	effectiveUserPrompt := userPrompt
-	isTranscription := isTranscriptionTask(systemPrompt)
-	if isTranscription && systemPrompt != "" {
-		effectiveSystemPrompt = systemPrompt + systemPromptReinforcement
-		// Wrap short transcripts to prevent Claude from treating them as conversation
-		effectiveUserPrompt = wrapShortTranscript(userPrompt)
-		if len(userPrompt) < 200 {
-			log.Printf("Detected short transcription (%d chars), adding wrapper", len(userPrompt))
+	msg := strings.ToLower(err.Error())
+	transient := false
+	for _, marker := range transientErrors {
+		if strings.Contains(msg, marker) {
+			transient = true
+			break
 		}
-		log.Printf("Detected transcription task, adding reinforcement")
+	}
+	if !transient {
+		return false
 	}
 
-	// Build command with proper system prompt separation
-	args := []string{"--print", "--model", model, "--output-format", "stream-json", "--verbose"}
-	if effectiveSystemPrompt != "" {
-		args = append(args, "--system-prompt", effectiveSystemPrompt)
+	delay := 500 * time.Millisecond << attempt
+	run.log.Warnf("Claude CLI attempt %d failed (%v), retrying in %v", attempt+1, err, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	cmd := exec.Command("claude", args...)
-	cmd.Stdin = strings.NewReader(effectiveUserPrompt)
+// trackRequests counts in-flight requests so shutdown can report how many
+// were drained
+func trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
+		next.ServeHTTP(w, r)
+	})
+}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Printf("Failed to create stdout pipe: %v", err)
-		sendSSEError(w, flusher, "Failed to start Claude CLI")
-		return
-	}
+// cors adds CORS headers to every response and answers preflight OPTIONS
+// requests itself, before auth, so browser apps can call the proxy directly.
+// CORS_ORIGIN is "*" or a comma-separated list of allowed origins.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if allowed := corsAllowedOrigin(origin); allowed != "" {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				h.Add("Vary", "Origin")
+			}
+			h.Set("Access-Control-Expose-Headers", "X-Request-Id, X-Usage-Source, X-Model-Used, X-Proxy-Cache, X-Time-To-First-Token-Ms, X-Proxy-Timing, X-Claude-CLI-Version, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", reqHeaders)
+			} else {
+				h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key, X-Request-Id, Anthropic-Version, X-Proxy-Dry-Run, X-Conversation-Id, X-Claude-Workdir, X-Claude-Model, X-Proxy-Cache, X-Proxy-Debug, X-Proxy-Stream")
+			}
+			h.Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	log.Printf("Processing streaming request (model: %s, system: %d chars, user: %d chars, transcription: %v)", model, len(effectiveSystemPrompt), len(userPrompt), isTranscription)
-	start := time.Now()
+// corsAllowedOrigin returns the Access-Control-Allow-Origin value for a
+// request from origin, or "" if the origin isn't allowed
+func corsAllowedOrigin(origin string) string {
+	if corsOrigin == "*" {
+		return "*"
+	}
+	if origin == "" {
+		return ""
+	}
+	for _, o := range strings.Split(corsOrigin, ",") {
+		if strings.TrimSpace(o) == origin {
+			return origin
+		}
+	}
+	return ""
+}
 
-	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start Claude CLI: %v", err)
-		sendSSEError(w, flusher, "Failed to start Claude CLI")
+// shutdown stops accepting connections and lets in-flight requests finish.
+// Requests still running after shutdownTimeout have their CLI processes
+// killed so the proxy never leaves orphaned children behind.
+func shutdown(server *http.Server) {
+	inFlight := atomic.LoadInt64(&activeRequests)
+	logger.Infof("Shutting down, draining %d in-flight requests (up to %v)", inFlight, shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err == nil {
+		logger.Infof("Shutdown complete: %d drained, 0 terminated", inFlight)
 		return
 	}
 
-	chatID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
-	created := time.Now().Unix()
-	sentRole := false
+	remaining := atomic.LoadInt64(&activeRequests)
+	logger.Warnf("Drain deadline reached, killing CLI processes for %d requests", remaining)
+	terminateCLI()
 
-	scanner := bufio.NewScanner(stdout)
-	// Increase buffer size for large JSON lines
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024)
+	// Killed processes make their handlers return almost immediately
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&activeRequests) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	server.Close()
+	logger.Infof("Shutdown complete: %d drained, %d terminated", inFlight-remaining, remaining)
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
+// newClaudeCommand builds a claude CLI invocation bound to ctx. When ctx is
+// cancelled or times out the whole process group is killed, so nothing the
+// CLI spawned is left running.
+func newClaudeCommand(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, claudeBin, args...)
+	if len(claudeEnv) > 0 {
+		// Later entries win, so CLAUDE_ENV overrides what the proxy inherited
+		cmd.Env = append(os.Environ(), claudeEnv...)
+	}
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
 
-		var msg map[string]interface{}
-		if err := json.Unmarshal([]byte(line), &msg); err != nil {
-			continue
-		}
+// tailBuffer keeps the last max bytes written to it, enough to explain a CLI
+// failure without holding an unbounded stderr in memory
+type tailBuffer struct {
+	max int
+	buf []byte
+}
 
-		msgType, _ := msg["type"].(string)
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
 
-		// Handle assistant message with content
-		if msgType == "assistant" {
-			if message, ok := msg["message"].(map[string]interface{}); ok {
-				if content, ok := message["content"].([]interface{}); ok {
-					for _, c := range content {
-						if contentMap, ok := c.(map[string]interface{}); ok {
-							if text, ok := contentMap["text"].(string); ok && text != "" {
-								// Send role first if not sent
-								if !sentRole {
-									chunk := ChatResponse{
-										ID:      chatID,
-										Object:  "chat.completion.chunk",
-										Created: created,
-										Model:   model,
-										Choices: []Choice{{
-											Index: 0,
-											Delta: &Delta{Role: "assistant"},
-										}},
-									}
-									sendSSEChunk(w, flusher, chunk)
-									sentRole = true
-								}
-
-								// Send content chunk
-								chunk := ChatResponse{
-									ID:      chatID,
-									Object:  "chat.completion.chunk",
-									Created: created,
-									Model:   model,
-									Choices: []Choice{{
-										Index: 0,
-										Delta: &Delta{Content: text},
-									}},
-								}
-								sendSSEChunk(w, flusher, chunk)
-							}
-						}
-					}
-				}
-			}
-		}
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
 
-		// Handle result message (final)
-		if msgType == "result" {
-			if result, ok := msg["result"].(string); ok && result != "" && !sentRole {
-				// Fallback: send full result if we didn't get streaming content
-				chunk := ChatResponse{
-					ID:      chatID,
-					Object:  "chat.completion.chunk",
-					Created: created,
-					Model:   model,
-					Choices: []Choice{{
-						Index: 0,
-						Delta: &Delta{Role: "assistant", Content: result},
-					}},
-				}
-				sendSSEChunk(w, flusher, chunk)
-				sentRole = true
-			}
+// lineWriter calls fn with each line written to it. exec copies the CLI's
+// stderr into it from a goroutine of its own that cmd.Wait waits for, so fn
+// is never called once Wait has returned. Overlong lines are passed on in
+// pieces.
+type lineWriter struct {
+	fn  func(line string)
+	buf []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
 		}
+		l.emit(l.buf[:i])
+		l.buf = l.buf[i+1:]
 	}
+	if len(l.buf) > 4096 {
+		l.flush()
+	}
+	return len(p), nil
+}
 
-	// Send final chunk with finish_reason
-	finalChunk := ChatResponse{
-		ID:      chatID,
-		Object:  "chat.completion.chunk",
-		Created: created,
-		Model:   model,
-		Choices: []Choice{{
-			Index:        0,
-			Delta:        &Delta{},
-			FinishReason: "stop",
-		}},
+// flush passes on a last line that had no newline
+func (l *lineWriter) flush() {
+	if len(l.buf) > 0 {
+		l.emit(l.buf)
+		l.buf = nil
 	}
-	sendSSEChunk(w, flusher, finalChunk)
+}
 
-	// Send [DONE]
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+func (l *lineWriter) emit(line []byte) {
+	// A stray carriage return would end an SSE line early
+	l.fn(strings.ReplaceAll(string(line), "\r", ""))
+}
 
-	cmd.Wait()
-	log.Printf("Streaming response completed in %v", time.Since(start))
+// debugStream reports whether a stream should carry the CLI's stderr as SSE
+// comments: DEBUG must be on and the client must send X-Proxy-Debug: true
+func debugStream(r *http.Request) bool {
+	on, _ := strconv.ParseBool(r.Header.Get("X-Proxy-Debug"))
+	return on && debugMode
 }
 
-func sendSSEChunk(w http.ResponseWriter, flusher http.Flusher, chunk ChatResponse) {
-	data, _ := json.Marshal(chunk)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	flusher.Flush()
+// forceStream overrides the stream flag of a chat completion request, for
+// clients that can't handle what they asked for: X-Proxy-Stream: true or
+// false, or else FORCE_STREAMING or FORCE_NON_STREAMING. ok is false if the
+// header isn't a boolean.
+func forceStream(r *http.Request, stream bool) (bool, bool) {
+	if v := strings.TrimSpace(r.Header.Get("X-Proxy-Stream")); v != "" {
+		on, err := strconv.ParseBool(v)
+		return on, err == nil
+	}
+	switch {
+	case forceStreaming:
+		return true, true
+	case forceNonStreaming:
+		return false, true
+	}
+	return stream, true
 }
 
-func sendSSEError(w http.ResponseWriter, flusher http.Flusher, message string) {
-	errResp := map[string]interface{}{
-		"error": map[string]string{
-			"message": message,
-			"type":    "error",
-		},
+// cliError describes a failed CLI run for the client, including the tail of
+// what it printed to stderr once sanitized (the raw text is only logged)
+func cliError(err error, stderr string) error {
+	if detail := sanitizeCLIOutput(stderr); detail != "" {
+		return fmt.Errorf("%v: %s", err, detail)
 	}
-	data, _ := json.Marshal(errResp)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	return err
 }
 
-func sendError(w http.ResponseWriter, message string, status int) {
-	w.WriteHeader(status)
-	resp := ErrorResponse{}
-	resp.Error.Message = message
-	resp.Error.Type = "error"
+// Patterns scrubbed from CLI output before it is shown to clients
+var (
+	secretPattern = regexp.MustCompile(`(?i)(sk-ant-[\w-]+|sk-[\w-]{16,}|bearer\s+[\w.~+/=-]+|(?:api[_-]?key|token|secret|password)["']?\s*[:=]\s*["']?[^\s"',)]+)`)
+	pathPattern   = regexp.MustCompile(`(?:[A-Za-z]:)?(?:[\\/][\w.@~+-]+){2,}[\\/]?`)
+)
+
+// sanitizeCLIOutput trims CLI error output for a client: credentials and
+// file paths are redacted and only the tail is kept, the last line by default
+// or the last 2000 characters with DEBUG=true
+func sanitizeCLIOutput(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	text = secretPattern.ReplaceAllString(text, "[redacted]")
+	text = pathPattern.ReplaceAllString(text, "[path]")
+
+	limit := 200
+	if debugMode {
+		limit = 2000
+	} else if i := strings.LastIndex(text, "\n"); i >= 0 {
+		text = strings.TrimSpace(text[i+1:])
+	}
+	if len(text) > limit {
+		cut := len(text) - limit
+		for cut < len(text) && !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		text = "..." + text[cut:]
+	}
+	return text
+}
+
+// loadProxySystemPrompt reads PROXY_SYSTEM_PROMPT, or the file named by
+// PROXY_SYSTEM_PROMPT_FILE
+func loadProxySystemPrompt() (string, error) {
+	prompt := strings.TrimSpace(os.Getenv("PROXY_SYSTEM_PROMPT"))
+	path := os.Getenv("PROXY_SYSTEM_PROMPT_FILE")
+	if path == "" {
+		return prompt, nil
+	}
+	if prompt != "" {
+		return "", fmt.Errorf("Set only one of PROXY_SYSTEM_PROMPT and PROXY_SYSTEM_PROMPT_FILE")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Invalid PROXY_SYSTEM_PROMPT_FILE: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// normalizeModel extracts the base model name (haiku, sonnet, opus), or ""
+// if m isn't a model we know
+func normalizeModel(m string) string {
+	m = strings.ToLower(strings.TrimSpace(m))
+	// Strip common prefixes
+	m = strings.TrimPrefix(m, "claude-")
+	m = strings.TrimPrefix(m, "claude_")
+	// Handle versioned names like "haiku-4-5" -> "haiku" and older ones
+	// like "claude-3-5-sonnet-20241022" -> "sonnet"
+	for _, model := range modelCatalog {
+		if strings.HasPrefix(m, model.Base) || strings.Contains(m, "-"+model.Base) {
+			return model.Base
+		}
+	}
+	return ""
+}
+
+// resolveModel picks the CLI model for a client-supplied name: MODEL_ALIASES
+// first, then normalization. Empty or unknown names get the default model,
+// so a bogus name never reaches the CLI; the bool is false when that happened.
+func resolveModel(requested string) (string, bool) {
+	m := strings.ToLower(strings.TrimSpace(requested))
+	if m == "" {
+		return defaultModel, false
+	}
+	reloadMu.RLock()
+	alias, ok := modelAliases[m]
+	reloadMu.RUnlock()
+	if ok {
+		m = alias
+	}
+	if base := normalizeModel(m); base != "" {
+		return base, true
+	}
+	return defaultModel, false
+}
+
+// modelDefault is what MODEL_DEFAULTS supplies for one base model when the
+// client doesn't set it. max_tokens is enforced by the proxy like a client's.
+type modelDefault struct {
+	Temperature  *float64 `json:"temperature"` // refused: the CLI has no sampling options
+	MaxTokens    *int     `json:"max_tokens"`
+	SystemPrefix string   `json:"system_prefix"` // goes ahead of the client's system prompt
+}
+
+// parseModelDefaults reads MODEL_DEFAULTS, a JSON object keyed by model, e.g.
+// {"opus": {"max_tokens": 4096, "system_prefix": "Be concise."}}
+func parseModelDefaults(v string) (map[string]modelDefault, error) {
+	defaults := map[string]modelDefault{}
+	if strings.TrimSpace(v) == "" {
+		return defaults, nil
+	}
+	var raw map[string]modelDefault
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	for name, d := range raw {
+		base := normalizeModel(name)
+		if base == "" {
+			return nil, fmt.Errorf("unknown model %q", name)
+		}
+		if d.Temperature != nil {
+			return nil, fmt.Errorf("%s: temperature can't be set, as the CLI has no sampling options", name)
+		}
+		if d.MaxTokens != nil && *d.MaxTokens <= 0 {
+			return nil, fmt.Errorf("%s: max_tokens must be a positive integer", name)
+		}
+		defaults[base] = d
+	}
+	return defaults, nil
+}
+
+// parseModelAliases reads MODEL_ALIASES, either a JSON object or
+// "name=model,name=model". Names match case-insensitively.
+func parseModelAliases(v string) (map[string]string, error) {
+	raw := map[string]string{}
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, err
+		}
+	} else if v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, model, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected name=model, got %q", pair)
+			}
+			raw[name] = model
+		}
+	}
+
+	aliases := make(map[string]string, len(raw))
+	for name, model := range raw {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || normalizeModel(model) == "" {
+			return nil, fmt.Errorf("%q must map to haiku, sonnet or opus, got %q", name, model)
+		}
+		aliases[name] = strings.TrimSpace(model)
+	}
+	return aliases, nil
+}
+
+// parseEffortModels reads REASONING_EFFORT_MODELS, either a JSON object or
+// "effort=model,effort=model", on top of the default mapping
+func parseEffortModels(v string) (map[string]string, error) {
+	efforts := map[string]string{"minimal": "haiku", "low": "haiku", "medium": "sonnet", "high": "opus"}
+	raw := map[string]string{}
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, err
+		}
+	} else if v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			effort, model, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected effort=model, got %q", pair)
+			}
+			raw[effort] = model
+		}
+	}
+	for effort, model := range raw {
+		effort = strings.ToLower(strings.TrimSpace(effort))
+		base := normalizeModel(model)
+		if effort == "" || base == "" {
+			return nil, fmt.Errorf("%q must map to haiku, sonnet or opus, got %q", effort, model)
+		}
+		efforts[effort] = base
+	}
+	return efforts, nil
+}
+
+// parseModelFallbacks reads MODEL_FALLBACK, either a JSON object of lists or
+// "model=fallback:fallback,model=fallback", e.g. "opus=sonnet:haiku"
+func parseModelFallbacks(v string) (map[string][]string, error) {
+	raw := map[string][]string{}
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, err
+		}
+	} else if v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			model, chain, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("expected model=fallback:fallback, got %q", pair)
+			}
+			raw[model] = strings.Split(chain, ":")
+		}
+	}
+
+	fallbacks := make(map[string][]string, len(raw))
+	for model, chain := range raw {
+		base := normalizeModel(model)
+		if base == "" {
+			return nil, fmt.Errorf("unknown model %q", model)
+		}
+		for _, next := range chain {
+			nextBase := normalizeModel(next)
+			if nextBase == "" {
+				return nil, fmt.Errorf("%s: unknown fallback model %q", base, next)
+			}
+			if nextBase != base {
+				fallbacks[base] = append(fallbacks[base], nextBase)
+			}
+		}
+	}
+	return fallbacks, nil
+}
+
+// parseAllowedModels reads ALLOWED_MODELS, a comma-separated list of models
+// normalized to their base names. An empty list allows every model.
+func parseAllowedModels(v string) (map[string]bool, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	allowed := map[string]bool{}
+	for _, name := range strings.Split(v, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		base := normalizeModel(name)
+		if base == "" {
+			return nil, fmt.Errorf("unknown model %q", strings.TrimSpace(name))
+		}
+		allowed[base] = true
+	}
+	return allowed, nil
+}
+
+func main() {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := applyConfigFile(path); err != nil {
+			logger.Fatalf("Invalid CONFIG_FILE: %v", err)
+		}
+	}
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL"))); v != "" {
+		level, ok := logLevels[v]
+		if !ok || level > logLevels["error"] {
+			logger.Fatalf("LOG_LEVEL must be trace, debug, info, warn or error")
+		}
+		logLevel = level
+	}
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))) {
+	case "", "text":
+	case "json":
+		logJSON = true
+	default:
+		logger.Fatalf("LOG_FORMAT must be text or json")
+	}
+
+	apiKey = os.Getenv("PROXY_API_KEY")
+	if apiKey == "" {
+		logger.Fatalf("PROXY_API_KEY environment variable required")
+	}
+	adminKey = os.Getenv("ADMIN_KEY")
+	if adminKey != "" && adminKey == apiKey {
+		logger.Fatalf("ADMIN_KEY must differ from PROXY_API_KEY")
+	}
+
+	defaultModel = os.Getenv("CLAUDE_MODEL")
+	if defaultModel == "" {
+		defaultModel = "sonnet" // Default to sonnet
+	}
+	if defaultModel = normalizeModel(defaultModel); defaultModel == "" {
+		logger.Fatalf("CLAUDE_MODEL must be haiku, sonnet or opus")
+	}
+
+	aliases, err := parseModelAliases(os.Getenv("MODEL_ALIASES"))
+	if err != nil {
+		logger.Fatalf("Invalid MODEL_ALIASES: %v", err)
+	}
+	modelAliases = aliases
+
+	if modelDefaults, err = parseModelDefaults(os.Getenv("MODEL_DEFAULTS")); err != nil {
+		logger.Fatalf("Invalid MODEL_DEFAULTS: %v", err)
+	}
+	if allowedModels, err = parseAllowedModels(os.Getenv("ALLOWED_MODELS")); err != nil {
+		logger.Fatalf("Invalid ALLOWED_MODELS: %v", err)
+	}
+	if modelFallbacks, err = parseModelFallbacks(os.Getenv("MODEL_FALLBACK")); err != nil {
+		logger.Fatalf("Invalid MODEL_FALLBACK: %v", err)
+	}
+	if effortModels, err = parseEffortModels(os.Getenv("REASONING_EFFORT_MODELS")); err != nil {
+		logger.Fatalf("Invalid REASONING_EFFORT_MODELS: %v", err)
+	}
+	mapEffort, _ = strconv.ParseBool(os.Getenv("MAP_REASONING_EFFORT"))
+
+	requestTimeout = envDuration("CLAUDE_TIMEOUT", 120*time.Second)
+	imageInput = os.Getenv("IMAGE_INPUT") != "false"
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("HISTORY_MODE"))); v {
+	case "":
+	case "transcript", "full", "last-user-only":
+		historyMode = v
+	default:
+		logger.Fatalf("HISTORY_MODE must be transcript, full or last-user-only")
+	}
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("SYSTEM_MESSAGE_POLICY"))); v {
+	case "":
+	case "inline", "hoist", "fold":
+		systemPolicy = v
+	default:
+		logger.Fatalf("SYSTEM_MESSAGE_POLICY must be inline, hoist or fold")
+	}
+	if maxBodyBytes = int64(envInt("MAX_BODY_BYTES", 10<<20)); maxBodyBytes < 1 {
+		logger.Fatalf("MAX_BODY_BYTES must be at least 1")
+	}
+	if maxPromptChars = envInt("MAX_PROMPT_CHARS", 0); maxPromptChars < 0 {
+		logger.Fatalf("MAX_PROMPT_CHARS must be 0 or more")
+	}
+	if maxPromptTokens = envInt("MAX_PROMPT_TOKENS", 0); maxPromptTokens < 0 {
+		logger.Fatalf("MAX_PROMPT_TOKENS must be 0 or more")
+	}
+	debugMode, _ = strconv.ParseBool(os.Getenv("DEBUG"))
+	ignoreLogprobs, _ = strconv.ParseBool(os.Getenv("IGNORE_LOGPROBS"))
+	includeThinking, _ = strconv.ParseBool(os.Getenv("INCLUDE_THINKING"))
+	if v := os.Getenv("FORCE_STREAMING"); v != "" {
+		if forceStreaming, err = strconv.ParseBool(v); err != nil {
+			logger.Fatalf("FORCE_STREAMING must be true or false")
+		}
+	}
+	if v := os.Getenv("FORCE_NON_STREAMING"); v != "" {
+		if forceNonStreaming, err = strconv.ParseBool(v); err != nil {
+			logger.Fatalf("FORCE_NON_STREAMING must be true or false")
+		}
+	}
+	trimOutput = true
+	if v := os.Getenv("TRIM_OUTPUT"); v != "" {
+		if trimOutput, err = strconv.ParseBool(v); err != nil {
+			logger.Fatalf("TRIM_OUTPUT must be true or false")
+		}
+	}
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("CLAUDE_OUTPUT_FORMAT"))); v != "" {
+		if v != "json" && v != "text" {
+			logger.Fatalf("CLAUDE_OUTPUT_FORMAT must be json or text")
+		}
+		outputFormat = v
+	}
+
+	if proxySystemPrompt, err = loadProxySystemPrompt(); err != nil {
+		logger.Fatalf("%v", err)
+	}
+	if dir := os.Getenv("SYSTEM_PROMPT_DIR"); dir != "" {
+		if err := initModelPrompts(dir); err != nil {
+			logger.Fatalf("Invalid SYSTEM_PROMPT_DIR: %v", err)
+		}
+	}
+	if proxySystemPrompt != "" {
+		logger.Infof("Proxy system prompt active (%d chars), prepended to every request", len(proxySystemPrompt))
+	}
+	userPromptPrefix = strings.TrimSpace(os.Getenv("USER_PROMPT_PREFIX"))
+	userPromptSuffix = strings.TrimSpace(os.Getenv("USER_PROMPT_SUFFIX"))
+
+	maxConcurrent := envInt("MAX_CONCURRENT", runtime.NumCPU())
+	if maxConcurrent < 1 {
+		logger.Fatalf("MAX_CONCURRENT must be at least 1")
+	}
+	cliSlots = make(chan struct{}, maxConcurrent)
+	if maxQueueDepth = int64(envInt("MAX_QUEUE_DEPTH", 0)); maxQueueDepth < 0 {
+		logger.Fatalf("MAX_QUEUE_DEPTH must be 0 or more")
+	}
+	queueTimeout = envDuration("QUEUE_TIMEOUT", 30*time.Second)
+	if size := envInt("RESPONSE_CACHE_SIZE", 0); size > 0 {
+		cache = newResponseCache(size, envDuration("RESPONSE_CACHE_TTL", 10*time.Minute))
+	}
+	if cliMaxRetries = envInt("CLAUDE_MAX_RETRIES", 2); cliMaxRetries < 0 {
+		logger.Fatalf("CLAUDE_MAX_RETRIES must not be negative")
+	}
+	if maxChoices = envInt("MAX_N", 4); maxChoices < 1 {
+		logger.Fatalf("MAX_N must be at least 1")
+	}
+	if maxBatchSize = envInt("MAX_BATCH_SIZE", maxBatchSize); maxBatchSize < 1 {
+		logger.Fatalf("MAX_BATCH_SIZE must be at least 1")
+	}
+
+	if dir := os.Getenv("CLAUDE_WORKDIR"); dir != "" {
+		if claudeWorkdir, err = checkWorkdir(dir); err != nil {
+			logger.Fatalf("Invalid CLAUDE_WORKDIR: %v", err)
+		}
+		logger.Infof("Running the CLI in %s", claudeWorkdir)
+	}
+	switch v := strings.TrimSpace(os.Getenv("CLI_SCHEMA_VERSION")); v {
+	case "", "1":
+	case "2":
+		cliSchema = 2
+	default:
+		logger.Fatalf("CLI_SCHEMA_VERSION must be 1 or 2")
+	}
+	if bin := strings.TrimSpace(os.Getenv("CLAUDE_BIN")); bin != "" {
+		claudeBin = bin
+	}
+	if path, err := exec.LookPath(claudeBin); err != nil {
+		logger.Warnf("claude CLI not found (%q): requests will fail with 503 until it is installed or CLAUDE_BIN points at it", claudeBin)
+	} else {
+		logger.Infof("Using claude CLI at %s", path)
+	}
+
+	template := defaultArgTemplate
+	if v := strings.TrimSpace(os.Getenv("CLAUDE_ARG_TEMPLATE")); v != "" {
+		template = v
+	}
+	var warnings []string
+	if argTemplate, warnings, err = parseArgTemplate(template); err != nil {
+		logger.Fatalf("Invalid CLAUDE_ARG_TEMPLATE: %v", err)
+	}
+	for _, warning := range warnings {
+		logger.Warnf("CLAUDE_ARG_TEMPLATE: %s", warning)
+	}
+	if extraArgs, err = parseExtraArgs(os.Getenv("CLAUDE_EXTRA_ARGS")); err != nil {
+		logger.Fatalf("Invalid CLAUDE_EXTRA_ARGS: %v", err)
+	}
+	if claudeEnv, err = parseClaudeEnv(os.Getenv("CLAUDE_ENV")); err != nil {
+		logger.Fatalf("Invalid CLAUDE_ENV: %v", err)
+	}
+	if preHook, err = splitArgs(os.Getenv("PRE_HOOK")); err != nil {
+		logger.Fatalf("Invalid PRE_HOOK: %v", err)
+	}
+	if postHook, err = splitArgs(os.Getenv("POST_HOOK")); err != nil {
+		logger.Fatalf("Invalid POST_HOOK: %v", err)
+	}
+	if hookTimeout = envDuration("HOOK_TIMEOUT", hookTimeout); hookTimeout <= 0 {
+		logger.Fatalf("HOOK_TIMEOUT must be positive")
+	}
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("HOOK_FAILURE"))) {
+	case "", "closed":
+	case "open":
+		hookFailOpen = true
+	default:
+		logger.Fatalf("HOOK_FAILURE must be open or closed")
+	}
+	// Logs the CLI's version, or warns; a broken CLI doesn't stop startup
+	checkCLI()
+	warnIfInit()
+
+	if reaperInterval = envDuration("REAPER_INTERVAL", reaperInterval); reaperInterval > 0 {
+		go reap()
+	}
+	if ttl := envDuration("SESSION_TTL", 30*time.Minute); ttl > 0 {
+		conversations = newConversationStore(ttl)
+	}
+
+	if rpm := envInt("RATE_LIMIT_RPM", 0); rpm > 0 {
+		limiter = newRateLimiter(rpm)
+	}
+	if rpm := envInt("USER_RATE_LIMIT_RPM", 0); rpm > 0 {
+		userLimiter = newRateLimiter(rpm)
+	}
+	if rpm := envInt("IP_RATE_LIMIT_RPM", 0); rpm > 0 {
+		ipLimiter = newRateLimiter(rpm)
+	}
+
+	if upstream := os.Getenv("EMBEDDINGS_UPSTREAM_URL"); upstream != "" {
+		if embeddingsProxy, err = newEmbeddingsProxy(upstream, os.Getenv("EMBEDDINGS_UPSTREAM_KEY")); err != nil {
+			logger.Fatalf("Invalid EMBEDDINGS_UPSTREAM_URL: %v", err)
+		}
+	}
+	shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	readHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", 10*time.Second)
+	readTimeout = envDuration("READ_TIMEOUT", 60*time.Second)
+	writeTimeout = envDuration("WRITE_TIMEOUT", 0)
+	idleTimeout = envDuration("IDLE_TIMEOUT", 120*time.Second)
+	if maxHeaderBytes = envInt("MAX_HEADER_BYTES", 64<<10); maxHeaderBytes <= 0 {
+		logger.Fatalf("MAX_HEADER_BYTES must be a positive integer")
+	}
+	if maxConnections = envInt("MAX_CONNECTIONS", 0); maxConnections < 0 {
+		logger.Fatalf("MAX_CONNECTIONS must be 0 or more")
+	}
+	if writeTimeout > 0 && writeTimeout < queueTimeout+requestTimeout {
+		logger.Warnf("WRITE_TIMEOUT (%v) is shorter than QUEUE_TIMEOUT + CLAUDE_TIMEOUT (%v); slow non-streaming replies will be cut off", writeTimeout, queueTimeout+requestTimeout)
+	}
+	pingInterval = envDuration("SSE_PING_INTERVAL", pingInterval)
+	if ms := envInt("STREAM_BATCH_MS", 0); ms < 0 {
+		logger.Fatalf("STREAM_BATCH_MS must be 0 or more")
+	} else {
+		streamBatch = time.Duration(ms) * time.Millisecond
+	}
+
+	if allowNets, err = parseCIDRs(os.Getenv("ALLOW_CIDRS")); err != nil {
+		logger.Fatalf("Invalid ALLOW_CIDRS: %v", err)
+	}
+	if denyNets, err = parseCIDRs(os.Getenv("DENY_CIDRS")); err != nil {
+		logger.Fatalf("Invalid DENY_CIDRS: %v", err)
+	}
+	if v := os.Getenv("TRUST_PROXY"); v != "" {
+		if trustProxy, err = strconv.ParseBool(v); err != nil {
+			logger.Fatalf("TRUST_PROXY must be true or false")
+		}
+	}
+	if trustedProxies, err = parseCIDRs(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		logger.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	if len(trustedProxies) > 0 && !trustProxy {
+		logger.Warnf("TRUSTED_PROXIES is set without TRUST_PROXY, so it has no effect")
+	}
+
+	corsOrigin = strings.TrimSpace(os.Getenv("CORS_ORIGIN"))
+	if corsOrigin == "" {
+		corsOrigin = "*"
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("USAGE_MODE"))); mode {
+	case "":
+	case "cli", "estimate", "off":
+		usageMode = mode
+	default:
+		logger.Fatalf("USAGE_MODE must be cli, estimate or off")
+	}
+	if path := strings.TrimSpace(os.Getenv("TOKENIZER_FILE")); path != "" {
+		var err error
+		if tokenizer, err = loadTokenizer(path); err != nil {
+			logger.Fatalf("Invalid TOKENIZER_FILE: %v", err)
+		}
+		logger.Infof("Counting tokens with %s (%d tokens)", path, len(tokenizer.ranks))
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	socketPath := os.Getenv("LISTEN_SOCKET")
+	socketMode := os.FileMode(0o660)
+	if v := os.Getenv("LISTEN_SOCKET_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0o777 {
+			logger.Fatalf("LISTEN_SOCKET_MODE must be an octal permission like 660")
+		}
+		socketMode = os.FileMode(mode)
+	}
+	if err := validateConfig(); err != nil {
+		logger.Fatalf("%v", err)
+	}
+	if socketPath != "" && strings.TrimSpace(os.Getenv("PORT")) != "" {
+		logger.Warnf("Both PORT and LISTEN_SOCKET are set, listening on the socket only")
+	}
+
+	http.HandleFunc("/v1/chat/completions", rateLimited(withCLIVersion(cancellable(handleChat))))
+	http.HandleFunc("/v1/completions", rateLimited(withCLIVersion(cancellable(handleCompletions))))
+	http.HandleFunc("/v1/messages", rateLimited(withCLIVersion(cancellable(handleMessages))))
+	http.HandleFunc("/v1/cancel", handleCancel)
+	http.HandleFunc("/v1/embeddings", handleEmbeddings)
+	http.HandleFunc("/v1/models", handleModels)
+	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/v1/conversations/", handleConversation)
+	http.HandleFunc("/ready", handleReady)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/admin/reload", handleReload)
+
+	if target := strings.TrimSpace(os.Getenv("AUDIT_LOG")); target != "" {
+		if audit, err = openAuditLog(target); err != nil {
+			logger.Fatalf("Invalid AUDIT_LOG: %v", err)
+		}
+		sink := audit.path
+		if audit.url != "" {
+			sink = "a webhook" // its URL may hold a token
+		}
+		logger.Warnf("AUDIT_LOG is on: full prompts and responses are recorded to %s", sink)
+	}
+	if path := os.Getenv("ACCESS_LOG"); path != "" {
+		if access, err = openAccessLog(path); err != nil {
+			logger.Fatalf("Invalid ACCESS_LOG: %v", err)
+		}
+	}
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	var certs *certReloader
+	if certFile != "" && keyFile != "" {
+		if certs, err = newCertReloader(certFile, keyFile); err != nil {
+			logger.Fatalf("Invalid TLS certificate: %v", err)
+		}
+	}
+
+	ln, addr, err := listen(port, socketPath, socketMode)
+	if err != nil {
+		logger.Fatalf("Failed to listen: %v", err)
+	}
+	if maxConnections > 0 {
+		ln = newLimitListener(ln, maxConnections)
+	}
+	scheme := "http"
+	if certs != nil {
+		scheme = "https"
+	}
+	startLog, features := configSummary(addr, scheme, maxConcurrent)
+	enabled := "none"
+	if len(features) > 0 {
+		enabled = strings.Join(features, ", ")
+	}
+	startLog.Infof("Claude Code proxy starting on %s (%s, default model: %s, timeout: %v, max concurrent: %d, streaming: enabled, features: %s)", addr, scheme, defaultModel, requestTimeout, maxConcurrent, enabled)
+	server := &http.Server{
+		Handler:           trackRequests(logRequests(ipFilter(cors(compress(http.DefaultServeMux))))),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	if certs != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		serve := func() error { return server.Serve(ln) }
+		if certs != nil {
+			// The certificate comes from TLSConfig, not the file arguments
+			serve = func() error { return server.ServeTLS(ln, "", "") }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("%v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server)
+	if audit != nil {
+		audit.close(5 * time.Second)
+	}
+}
+
+// readBody reads a request body of at most MAX_BODY_BYTES, before anything
+// tries to parse it. A gzip or deflate body is decompressed, and the limit
+// applies both before and after, so a small bomb can't expand without bound.
+// On error it also returns the status to reject with.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	decoded, err := decodeBody(r.Header.Get("Content-Encoding"), http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(io.LimitReader(decoded, maxBodyBytes+1))
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || int64(len(body)) > maxBodyBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Request body exceeds %d bytes", maxBodyBytes)
+	}
+	if errors.Is(err, errUnsupportedEncoding) {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+	if err != nil && r.Header.Get("Content-Encoding") != "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("Failed to decompress request: %v", err)
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Failed to read request")
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, http.StatusBadRequest, errors.New("Request body is empty")
+	}
+	return body, 0, nil
+}
+
+// ignoreLogitBias logs that a request's logit_bias is ignored. Small biases
+// only nudge sampling, so that is just a debug line, but -100 and 100 are
+// meant to ban or force a token, and the reply may well not honor that.
+func ignoreLogitBias(log *Logger, bias map[string]float64) {
+	if len(bias) == 0 {
+		return
+	}
+	var absolute []string
+	for token, b := range bias {
+		if b <= -100 || b >= 100 {
+			absolute = append(absolute, token)
+		}
+	}
+	if len(absolute) > 0 {
+		sort.Strings(absolute)
+		log.Warnf("Ignoring logit_bias, which the CLI can't apply: tokens %s will not be banned or forced", strings.Join(absolute, ", "))
+		return
+	}
+	log.Debugf("Ignoring logit_bias for %d tokens, which the CLI can't apply", len(bias))
+}
+
+// decodeRequest parses a request body into v. Its error names what is wrong,
+// such as a string where a field takes a boolean, rather than only that the
+// JSON wouldn't parse, so client authors can tell which field to fix.
+func decodeRequest(body []byte, v interface{}) error {
+	err := json.Unmarshal(body, v)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("Invalid JSON: %v (at byte %d)", err, syntaxErr.Offset)
+	case errors.As(err, &typeErr) && typeErr.Field == "":
+		return fmt.Errorf("Invalid JSON: the request body must be an object, not %s", typeErr.Value)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("invalid type for '%s': expected %s", typeErr.Field, jsonKind(typeErr.Type))
+	default:
+		// Fields with their own parsing, like content or stop, already say
+		// what they accept
+		return err
+	}
+}
+
+// jsonKind names the JSON type that decodes into t
+func jsonKind(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// clearWriteDeadline exempts an SSE stream from WRITE_TIMEOUT. Errors are
+// ignored: a writer without deadlines has no timeout to lift.
+func clearWriteDeadline(w http.ResponseWriter) {
+	if writeTimeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+}
+
+// authorized reports whether the request carries the proxy's API key, either
+// as an OpenAI-style Bearer token or in Anthropic's x-api-key header
+func authorized(r *http.Request) bool {
+	return requestKey(r) != ""
+}
+
+// requestKey returns the proxy API key the request authenticated with, or "".
+// The scheme is matched case-insensitively and stray whitespace is ignored,
+// as clients are inconsistent about both.
+func requestKey(r *http.Request) string {
+	if keyMatches(r.Header.Get("X-Api-Key")) {
+		return apiKey
+	}
+	if keyMatches(bearerToken(r)) {
+		return apiKey
+	}
+	return ""
+}
+
+// bearerToken returns the token of a Bearer Authorization header, or ""
+func bearerToken(r *http.Request) string {
+	if fields := strings.Fields(r.Header.Get("Authorization")); len(fields) == 2 && strings.EqualFold(fields[0], "Bearer") {
+		return fields[1]
+	}
+	return ""
+}
+
+// keyLabel names a key in logs without revealing it
+func keyLabel(key string) string {
+	return "key_" + hashText(key)[:8]
+}
+
+// keyMatches compares a presented key with the proxy's in constant time, so
+// response timing reveals nothing about how much of a guess was right
+func keyMatches(presented string) bool {
+	presented = strings.TrimSpace(presented)
+	return presented != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(apiKey)) == 1
+}
+
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authorized(r) {
+		sendError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := ModelList{Object: "list", Data: []ModelInfo{}}
+	for _, model := range modelCatalog {
+		for _, id := range append([]string{model.Base}, model.Aliases...) {
+			list.Data = append(list.Data, ModelInfo{
+				ID:      id,
+				Object:  "model",
+				Created: startedAt.Unix(),
+				OwnedBy: "anthropic",
+			})
+		}
+	}
+	// Configured aliases are valid model names too
+	var aliases []string
+	reloadMu.RLock()
+	for name := range modelAliases {
+		aliases = append(aliases, name)
+	}
+	reloadMu.RUnlock()
+	sort.Strings(aliases)
+	for _, name := range aliases {
+		list.Data = append(list.Data, ModelInfo{
+			ID:      name,
+			Object:  "model",
+			Created: startedAt.Unix(),
+			OwnedBy: "anthropic",
+		})
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
+
+func handleChat(w http.ResponseWriter, r *http.Request) {
+	// Verify API key
+	if !authorized(r) {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Allow", "POST")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse request
+	body, status, err := readBody(w, r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, err.Error(), status)
+		return
+	}
+	if isBatch(body) {
+		handleChatBatch(w, r, body)
+		return
+	}
+
+	var req ChatRequest
+	if err := decodeRequest(body, &req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.useModelHeader(r.Header.Get("X-Claude-Model"))
+	if !allowUser(w, r, req.User) {
+		return
+	}
+	stream, ok := forceStream(r, req.Stream)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, "X-Proxy-Stream must be true or false", http.StatusBadRequest)
+		return
+	}
+	if stream != req.Stream {
+		loggerFrom(r.Context()).Infof("Overriding stream: %v with %v", req.Stream, stream)
+		req.Stream = stream
+	}
+
+	// Log incoming messages for debugging. Only their shape, never their
+	// content, which is logged at trace level alone.
+	reqLog := loggerFrom(r.Context())
+	reqLog.Debugf("=== INCOMING REQUEST ===")
+	reqLog.Debugf("Model requested: %s", req.Model)
+	reqLog.Debugf("Stream: %v", req.Stream)
+	reqLog.Debugf("Messages count: %d", len(req.Messages))
+	for i, msg := range req.Messages {
+		reqLog.Debugf("  [%d] role=%s, content_len=%d", i, msg.Role, len(msg.Content.Text))
+	}
+
+	run, cleanup, err := prepareRun(r.Context(), req)
+	defer cleanup()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendRequestError(w, err)
+		return
+	}
+
+	if isDryRun(r) {
+		sendDryRun(w, run, req.Stream)
+		return
+	}
+	if err := run.useWorkdir(r.Header.Get("X-Claude-Workdir")); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	run.useConversation(r.Header.Get("X-Conversation-Id"))
+	run.useCache(r.Header.Get("X-Proxy-Cache"))
+	run.debugStderr = debugStream(r)
+	run.showTiming = showTiming(r)
+
+	// Bound the CLI run by the configured timeout; the request context also
+	// ends it early if the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	if req.Stream {
+		handleStreamingRequest(ctx, w, run)
+	} else {
+		handleNonStreamingRequest(ctx, w, run)
+	}
+}
+
+// claudeRun is a single CLI invocation, independent of which API flavor
+// (OpenAI or Anthropic) asked for it
+type claudeRun struct {
+	Req          ChatRequest
+	Model        string
+	SystemPrompt string // as assembled from the client's messages
+	UserPrompt   string
+	ImageDir     string
+
+	log           *Logger // tagged with the run's model and prompt size
+	transcription bool
+	cliSystem     string // what the CLI actually receives
+	cliInput      string
+
+	workdir      string            // where the CLI runs; see useWorkdir
+	onStart      func()            // streaming only: called once the CLI process is running
+	debugStderr  bool              // the client asked for stderr in the stream; see debugStream
+	onStderr     func(line string) // streaming only: called with each stderr line
+	conversation string            // the client's X-Conversation-Id, if sessions are on
+	resumeID     string            // the CLI session being resumed, if any
+	fullInput    string            // cliInput with the whole history, for when resuming fails
+	fallbacks    []string          // MODEL_FALLBACK models not tried yet
+	cacheKey     string            // set when the result may be cached; see useCache
+	cacheStatus  string            // "hit" or "miss" once a cacheable run is looked up
+	hookSkipped  bool              // POST_HOOK failed under HOOK_FAILURE=open, so the reply is unfiltered
+
+	started    time.Time     // when the request came in
+	firstText  sync.Once     // guards timeToText
+	timeToText time.Duration // streaming only: from started to the first text
+	showTiming bool          // the client asked for X-Proxy-Timing; see showTiming
+	timing     runTiming
+}
+
+// claudeResult is what the CLI produced for a run
+type claudeResult struct {
+	Text         string
+	StopReason   string    // as reported by the CLI: end_turn, max_tokens, ...
+	StopSequence string    // the client stop sequence that ended the text, if any
+	Usage        *cliUsage // as reported by the CLI; nil if it reported none
+	Err          error     // streaming only: the CLI failed after it started, so Text may be truncated
+	SessionID    string    // the CLI session the run took place in, if reported
+	TimedOut     bool      // streaming only: CLAUDE_TIMEOUT killed the CLI, so Text is partial
+}
+
+// prepareRun validates req and turns it into a claudeRun: images are written
+// to disk, prompts assembled and the model resolved. Errors are problems with
+// the request itself. cleanup must always be called, even on error.
+func prepareRun(ctx context.Context, req ChatRequest) (*claudeRun, func(), error) {
+	cleanup := func() {}
+
+	// PRE_HOOK goes first, so what it prints is checked like any request
+	if len(preHook) > 0 {
+		var err error
+		if req, err = applyPreHook(ctx, req); err != nil {
+			return nil, cleanup, err
+		}
+	}
+	if len(req.Messages) == 0 {
+		return nil, cleanup, fmt.Errorf("messages must not be empty")
+	}
+	if err := validateRoles(req.Messages); err != nil {
+		loggerFrom(ctx).Warnf("Rejecting request: %v", err)
+		return nil, cleanup, err
+	}
+	if !hasUserContent(req.Messages) {
+		return nil, cleanup, fmt.Errorf("messages must include at least one user message with content")
+	}
+	if req.MaxCompletionTokens != nil {
+		if *req.MaxCompletionTokens <= 0 {
+			return nil, cleanup, fmt.Errorf("max_completion_tokens must be a positive integer")
+		}
+		if req.MaxTokens != nil && *req.MaxTokens != *req.MaxCompletionTokens {
+			loggerFrom(ctx).Debugf("Using max_completion_tokens %d over max_tokens %d", *req.MaxCompletionTokens, *req.MaxTokens)
+		}
+		req.MaxTokens = req.MaxCompletionTokens
+	}
+	if req.MaxTokens != nil && *req.MaxTokens <= 0 {
+		return nil, cleanup, fmt.Errorf("max_tokens must be a positive integer")
+	}
+	if req.N != nil && (*req.N < 1 || *req.N > maxChoices) {
+		return nil, cleanup, fmt.Errorf("n must be between 1 and %d", maxChoices)
+	}
+	if !ignoreLogprobs && ((req.Logprobs != nil && *req.Logprobs) || (req.TopLogprobs != nil && *req.TopLogprobs > 0)) {
+		return nil, cleanup, fmt.Errorf("logprobs are not supported: the Claude CLI does not expose token probabilities")
+	}
+	if err := validateTools(req); err != nil {
+		return nil, cleanup, err
+	}
+	if err := validateResponseFormat(req); err != nil {
+		return nil, cleanup, err
+	}
+
+	// Write any image parts to a temp dir the CLI is allowed to read. The dir
+	// is removed by cleanup, whatever the outcome.
+	imageDir, err := materializeImages(ctx, req.Messages)
+	if imageDir != "" {
+		cleanup = func() { os.RemoveAll(imageDir) }
+	}
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	// Separate system prompt from conversation messages
+	systemPrompt, userPrompt := buildPrompts(req.Messages)
+	userPrompt = wrapUserPrompt(userPrompt)
+
+	requestModel, known := resolveModel(req.Model)
+	effort := strings.ToLower(strings.TrimSpace(req.ReasoningEffort))
+	fromEffort := effort != "" && (!known || mapEffort) && !req.modelFromHeader
+	if fromEffort {
+		model, ok := effortModels[effort]
+		if !ok {
+			var efforts []string
+			for name := range effortModels {
+				efforts = append(efforts, name)
+			}
+			sort.Strings(efforts)
+			return nil, cleanup, fmt.Errorf("reasoning_effort must be one of %s", strings.Join(efforts, ", "))
+		}
+		requestModel, known = model, true
+	}
+	switch {
+	case fromEffort:
+		loggerFrom(ctx).Infof("Model %s (from reasoning_effort %s)", requestModel, effort)
+	case !known:
+		if strings.TrimSpace(req.Model) != "" {
+			loggerFrom(ctx).Warnf("Unknown model %q, using default model %s", req.Model, defaultModel)
+		}
+		loggerFrom(ctx).Infof("Model %s (default)", requestModel)
+	case req.modelFromHeader:
+		loggerFrom(ctx).Infof("Model %s (from X-Claude-Model header)", requestModel)
+	default:
+		loggerFrom(ctx).Infof("Model %s (from request body)", requestModel)
+	}
+	reloadMu.RLock()
+	allowed := allowedModels
+	reloadMu.RUnlock()
+	if allowed != nil && !allowed[requestModel] {
+		log := loggerFrom(ctx)
+		key, _ := log.field("key").(string)
+		log.Warnf("Denied model %q (%s) for key %s: not in ALLOWED_MODELS", req.Model, requestModel, key)
+		return nil, cleanup, fmt.Errorf("%w: %s is not available on this proxy", errModelNotAllowed, requestModel)
+	}
+
+	for _, msg := range req.Messages {
+		if msg.Content.CacheHint {
+			loggerFrom(ctx).Debugf("Ignoring cache_control: the CLI caches prompts on its own")
+			break
+		}
+	}
+
+	if req.Seed != nil {
+		loggerFrom(ctx).Debugf("Seed %d only keys system_fingerprint: the CLI can't seed sampling", *req.Seed)
+	}
+
+	// Per-model defaults fill in whatever the client left unset
+	if d, ok := modelDefaults[requestModel]; ok {
+		if req.MaxTokens == nil {
+			req.MaxTokens = d.MaxTokens
+		}
+		systemPrompt = joinPrompts(d.SystemPrefix, systemPrompt)
+	}
+	// Then the model's prompt from SYSTEM_PROMPT_DIR
+	if prompt := modelPrompt(requestModel); prompt != "" {
+		loggerFrom(ctx).Debugf("Prepending SYSTEM_PROMPT_DIR prompt for %s (%d chars)", requestModel, len(prompt))
+		systemPrompt = joinPrompts(prompt, systemPrompt)
+	}
+	// The deployment's own system prompt always comes first
+	reloadMu.RLock()
+	proxyPrompt := proxySystemPrompt
+	reloadMu.RUnlock()
+	if proxyPrompt != "" {
+		loggerFrom(ctx).Infof("Prepending PROXY_SYSTEM_PROMPT (%d chars)", len(proxyPrompt))
+		systemPrompt = joinPrompts(proxyPrompt, systemPrompt)
+	}
+	// Client tools are described after everything else the model is told
+	if req.usesTools() {
+		loggerFrom(ctx).Infof("Offering %d tool(s) to Claude", len(req.Tools))
+		systemPrompt = joinPrompts(systemPrompt, toolsPrompt(req))
+	}
+	// The format instruction comes last, as the final word on the reply
+	if req.jsonMode() {
+		loggerFrom(ctx).Infof("JSON mode (%s)", req.ResponseFormat.Type)
+		systemPrompt = joinPrompts(systemPrompt, responseFormatPrompt(req))
+	}
+
+	log := loggerFrom(ctx).With("model", requestModel, "prompt_chars", len(systemPrompt)+len(userPrompt))
+	if req.User != "" {
+		log = log.With("user", req.User)
+		log.Infof("End user %q", req.User)
+	}
+	run := &claudeRun{
+		Req:          req,
+		Model:        requestModel,
+		started:      requestStart(ctx),
+		SystemPrompt: systemPrompt,
+		UserPrompt:   userPrompt,
+		ImageDir:     imageDir,
+		log:          log,
+		cliSystem:    systemPrompt,
+		cliInput:     userPrompt,
+		fallbacks:    modelFallbacks[requestModel],
+	}
+
+	run.log.Debugf("System prompt: %d chars, User prompt: %d chars", len(systemPrompt), len(userPrompt))
+	run.log.Tracef("System prompt:\n%s", systemPrompt)
+	run.log.Tracef("User prompt:\n%s", userPrompt)
+	if req.Temperature != nil || req.TopP != nil {
+		run.log.Infof("Ignoring temperature/top_p, which the CLI has no options for")
+	}
+	if (req.PresencePenalty != nil && *req.PresencePenalty != 0) || (req.FrequencyPenalty != nil && *req.FrequencyPenalty != 0) {
+		run.log.Infof("Ignoring presence_penalty/frequency_penalty, which Claude has no equivalent for")
+	}
+	ignoreLogitBias(run.log, req.LogitBias)
+
+	// Check if this is a transcription task and add reinforcement
+	run.transcription = isTranscriptionTask(systemPrompt)
+	if run.transcription && systemPrompt != "" {
+		run.cliSystem = systemPrompt + systemPromptReinforcement
+		// Wrap short transcripts to prevent Claude from treating them as conversation
+		run.cliInput = wrapShortTranscript(userPrompt)
+		if len(userPrompt) < 200 {
+			run.log.Infof("Detected short transcription (%d chars), adding wrapper", len(userPrompt))
+		}
+		run.log.Infof("Detected transcription task, adding reinforcement")
+	}
+
+	if err := run.checkPromptSize(); err != nil {
+		run.log.Warnf("Rejecting request: %v", err)
+		return nil, cleanup, err
+	}
+	return run, cleanup, nil
+}
+
+// checkPromptSize enforces MAX_PROMPT_CHARS and MAX_PROMPT_TOKENS on the
+// prompts as the CLI would receive them, so an oversized request fails fast
+// instead of the CLI failing on it slowly
+func (run *claudeRun) checkPromptSize() error {
+	if maxPromptChars > 0 {
+		if chars := utf8.RuneCountInString(run.cliSystem) + utf8.RuneCountInString(run.cliInput); chars > maxPromptChars {
+			return fmt.Errorf("%w: %d characters, more than the %d allowed", errPromptTooLong, chars, maxPromptChars)
+		}
+	}
+	if maxPromptTokens > 0 {
+		if tokens := countTokens(run.cliSystem) + countTokens(run.cliInput); tokens > maxPromptTokens {
+			return fmt.Errorf("%w: about %d tokens, more than the %d allowed", errPromptTooLong, tokens, maxPromptTokens)
+		}
+	}
+	return nil
+}
+
+// quotaErrors mark CLI failures that mean the model can't be used for now,
+// rather than that this one attempt went wrong
+var quotaErrors = []string{
+	"quota",
+	"usage limit",
+	"limit reached",
+	"rate limit",
+	"rate_limit",
+	"429",
+}
+
+// fallBack switches run to its next MODEL_FALLBACK model after a quota or
+// rate limit failure, and reports whether there was one. Runs with n > 1
+// share run across goroutines and never fall back.
+func (run *claudeRun) fallBack(err error) bool {
+	if len(run.fallbacks) == 0 || run.choices() > 1 {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	quota := false
+	for _, marker := range quotaErrors {
+		if strings.Contains(msg, marker) {
+			quota = true
+			break
+		}
+	}
+	if !quota {
+		return false
+	}
+
+	next := run.fallbacks[0]
+	run.fallbacks = run.fallbacks[1:]
+	run.log.Warnf("Model %s failed (%v), falling back to %s", run.Model, err, next)
+	run.Model = next
+	// A session belongs to its model, so the fallback replays the history
+	if run.resumeID != "" {
+		run.resumeID = ""
+		run.cliInput = run.fullInput
+	}
+	return true
+}
+
+// setResultHeaders reports the model that served the run in X-Model-Used,
+// whether a cacheable run came from the cache in X-Proxy-Cache, for streams
+// the time to first text in X-Time-To-First-Token-Ms, and if asked for, the
+// timing breakdown in X-Proxy-Timing. On streams these are trailers, as a
+// fallback is only known once the CLI ran.
+func (run *claudeRun) setResultHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Model-Used", run.Model)
+	if run.cacheStatus != "" {
+		w.Header().Set("X-Proxy-Cache", run.cacheStatus)
+	}
+	if run.timeToText > 0 {
+		w.Header().Set("X-Time-To-First-Token-Ms", strconv.FormatInt(run.timeToText.Milliseconds(), 10))
+	}
+	run.setTimingHeader(w)
+}
+
+// markFirstText records the time to first text, once per request however
+// many choices stream. Held back text (JSON mode) counts when the CLI
+// produced it, not when it is sent.
+func (run *claudeRun) markFirstText() {
+	run.firstText.Do(func() {
+		run.timeToText = time.Since(run.started)
+		run.log.With("ttft_ms", run.timeToText.Milliseconds()).Infof("First text after %v", run.timeToText)
+	})
+}
+
+// choices is how many completions the client asked for
+func (run *claudeRun) choices() int {
+	if run.Req.N == nil {
+		return 1
+	}
+	return *run.Req.N
+}
+
+// fingerprint is the run's system_fingerprint. It identifies the model and
+// seed, so it is stable across requests that share both.
+func (run *claudeRun) fingerprint() *string {
+	key := run.Model
+	if run.Req.Seed != nil {
+		key += "/" + strconv.Itoa(*run.Req.Seed)
+	}
+	fp := "fp_" + hashText(key)[:10]
+	return &fp
+}
+
+// args builds the CLI arguments for the run from CLAUDE_ARG_TEMPLATE
+func (run *claudeRun) args(stream bool) []string {
+	// JSON output carries the CLI's real token usage alongside the text
+	format := outputFormat
+	if stream {
+		format = "stream-json"
+	}
+	values := strings.NewReplacer(
+		"{model}", run.Model,
+		"{output_format}", format,
+		"{system_prompt}", run.cliSystem,
+		"{session_id}", run.resumeID,
+	)
+
+	var args []string
+	for _, word := range argTemplate {
+		switch word {
+		case "{stream_flags}":
+			// stream-json requires --verbose in print mode
+			if stream {
+				args = append(args, "--verbose")
+				if cliSchema == 2 {
+					args = append(args, "--include-partial-messages")
+				}
+			}
+		case "{system}":
+			if run.cliSystem != "" {
+				args = append(args, "--system-prompt", run.cliSystem)
+			}
+		case "{resume}":
+			if run.resumeID != "" {
+				args = append(args, "--resume", run.resumeID)
+			}
+		case "{images}":
+			args = append(args, imageArgs(run.ImageDir)...)
+		default:
+			args = append(args, values.Replace(word))
+		}
+	}
+	args = append(args, extraArgs...)
+	return args
+}
+
+// checkBreakage logs if a transcription response looks like Claude broke
+// character
+func (run *claudeRun) checkBreakage(response string) {
+	if run.transcription && detectBreakage(response) {
+		run.log.Warnf("Detected possible breakage in transcription response")
+		run.log.Tracef("User prompt was: %s", run.UserPrompt)
+		run.log.Tracef("Response was: %.500s", response)
+	}
+}
+
+// runClaude runs the CLI to completion and returns its output, retrying
+// transient failures up to cliMaxRetries times.
+// Callers should check ctx.Err() to tell a timeout from a CLI failure, and
+// errBusy for a full queue.
+func runClaude(ctx context.Context, run *claudeRun) (result claudeResult, err error) {
+	defer func() { run.audit(false, result, err) }()
+	if run.cacheKey != "" {
+		if result, ok := cache.get(run.cacheKey); ok {
+			run.log.Infof("Response cache hit")
+			run.cacheStatus = "hit"
+			return result, nil
+		}
+		run.log.Infof("Response cache miss")
+		run.cacheStatus = "miss"
+	}
+
+	waited := time.Now()
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		run.endConversation(claudeResult{}, err)
+		return claudeResult{}, err
+	}
+	defer release()
+	run.timing.queued(time.Since(waited))
+
+	jsonRetried := false
+	for attempt := 0; ; attempt++ {
+		result, err := runClaudeOnce(ctx, run)
+		// A reply that should be JSON and isn't gets one more try
+		if err == nil && run.Req.jsonMode() {
+			if result.Text, err = run.checkJSON(result.Text); err != nil && !jsonRetried && ctx.Err() == nil {
+				run.log.Warnf("Reply is not valid JSON, retrying once")
+				jsonRetried = true
+				// A resumed session now holds the bad reply, so start afresh
+				if run.resumeID != "" {
+					conversations.forget(run.conversation)
+					run.resumeID = ""
+					run.cliInput = run.fullInput
+				}
+				attempt--
+				continue
+			}
+		}
+		if err != nil && run.resumeID != "" && ctx.Err() == nil {
+			run.dropResume()
+			continue
+		}
+		// A fallback model gets its own retries
+		if err != nil && ctx.Err() == nil && run.fallBack(err) {
+			attempt = -1
+			continue
+		}
+		if err == nil || !shouldRetry(ctx, run, attempt, err) {
+			if err == nil && len(postHook) > 0 {
+				result.Text, err = run.postHook(ctx, result.Text)
+			}
+			run.endConversation(result, err)
+			// A fallback model's reply doesn't answer what the key describes,
+			// and an unfiltered one mustn't outlive the hook's outage
+			if err == nil && run.cacheKey != "" && run.cacheKey == run.responseCacheKey() && !run.hookSkipped {
+				cache.put(run.cacheKey, result)
+			}
+			return result, err
+		}
+	}
+}
+
+func runClaudeOnce(ctx context.Context, run *claudeRun) (claudeResult, error) {
+	ctx, cancel := withShutdown(ctx)
+	defer cancel()
+
+	cmd := newClaudeCommand(ctx, run.args(false))
+	cmd.Dir = run.workdir
+	cmd.Stdin = strings.NewReader(run.cliInput)
+
+	run.log.Infof("Processing request (model: %s, system: %d chars, user: %d chars, transcription: %v)", run.Model, len(run.cliSystem), len(run.UserPrompt), run.transcription)
+	start := time.Now()
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		run.log.Errorf("Claude CLI error: %v", err)
+		return claudeResult{}, startError(err)
+	}
+	untrack := trackProcess(cmd)
+	run.timing.spawned(time.Since(start))
+	err := cmd.Wait()
+	untrack()
+	elapsed := time.Since(start)
+	run.timing.generated(elapsed)
+	if err != nil {
+		run.log.Errorf("Claude CLI error: %v", err)
+		run.log.Errorf("Stderr: %s", stderr.String())
+		return claudeResult{}, cliError(err, stderr.String())
+	}
+	output := stdout.Bytes()
+
+	result := claudeResult{StopReason: "end_turn"}
+
+	var msg ClaudeStreamMessage
+	if outputFormat == "text" {
+		// Plain text ends with a newline of the CLI's own
+		output = bytes.TrimSuffix(output, []byte("\n"))
+	} else if err := json.Unmarshal(output, &msg); err == nil && msg.Type == "result" {
+		if msg.IsError {
+			run.log.Errorf("Claude CLI reported an error (%s): %.500s", msg.Subtype, msg.Result)
+			return claudeResult{}, fmt.Errorf("%s", sanitizeCLIOutput(msg.Result))
+		}
+		output = []byte(msg.Result)
+		result.Usage = msg.Usage
+		result.SessionID = msg.SessionID
+	} else {
+		// Older CLIs ignore --output-format and print plain text, ending
+		// with a newline of the CLI's own
+		run.log.Warnf("Claude CLI output was not a JSON result, using it as plain text")
+		output = bytes.TrimSuffix(output, []byte("\n"))
+	}
+
+	response := string(output)
+	if trimOutput {
+		response = strings.TrimSpace(response)
+	}
+	result.Text = response
+	run.log.With("duration_ms", elapsed.Milliseconds()).Infof("Response received in %v (%d chars)", elapsed, len(response))
+
+	if idx, seq := findStop(response, run.Req.Stop); idx >= 0 {
+		result.Text = response[:idx]
+		if trimOutput {
+			// A stream holds back the whitespace before the stop, too
+			result.Text = strings.TrimRightFunc(result.Text, unicode.IsSpace)
+		}
+		result.StopReason = "stop_sequence"
+		result.StopSequence = seq
+	}
+	// The CLI ran to the end, so a reply over max_tokens is cut here
+	limit := &tokenCap{max: run.Req.maxTokens()}
+	if text, hit := limit.Write(result.Text); hit {
+		result.Text = text
+		if trimOutput {
+			result.Text = strings.TrimRightFunc(result.Text, unicode.IsSpace)
+		}
+		result.StopReason = "max_tokens"
+		result.StopSequence = ""
+		run.log.Infof("Reply cut off at max_tokens (%d)", limit.max)
+	}
+
+	run.checkBreakage(result.Text)
+	return result, nil
+}
+
+// streamClaude runs the CLI with stream-json output and calls onText with
+// each piece of assistant text as it arrives, and onThinking, if not nil,
+// with each piece of extended thinking. The returned error is only set
+// when the CLI could not be started (including errBusy), in which case
+// nothing has been passed to onText; a failure after that is reported in
+// result.Err. Callers should check ctx.Err() to tell whether the run timed
+// out.
+func streamClaude(ctx context.Context, run *claudeRun, onText, onThinking func(text string)) (result claudeResult, err error) {
+	defer func() { run.audit(true, result, err) }()
+	waited := time.Now()
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		run.endConversation(claudeResult{}, err)
+		return claudeResult{}, err
+	}
+	defer release()
+	run.timing.queued(time.Since(waited))
+
+	// With STREAM_BATCH_MS, text is coalesced on its way to onText, and all
+	// of it is sent by the time this returns
+	if streamBatch > 0 {
+		batch := &textBatcher{emit: onText}
+		defer batch.flush()
+		onText = batch.add
+		if thinking := onThinking; thinking != nil {
+			onThinking = func(text string) {
+				batch.flush()
+				thinking(text)
+			}
+		}
+	}
+
+	// With POST_HOOK, the reply is held back and rewritten whole once the
+	// run ends, then sent in one piece
+	if len(postHook) > 0 {
+		var reply strings.Builder
+		emit := onText
+		onText = func(text string) { reply.WriteString(text) }
+		defer func() {
+			if err != nil || reply.Len() == 0 {
+				return
+			}
+			text, hookErr := run.postHook(ctx, reply.String())
+			if hookErr != nil {
+				result.Err = hookErr
+				return
+			}
+			result.Text = text
+			emit(text)
+		}()
+	}
+
+	// Once text has reached the client a failed run can't be retried
+	sent := false
+	send := func(text string) {
+		if !sent {
+			run.markFirstText()
+		}
+		sent = true
+		onText(text)
+	}
+	for attempt := 0; ; attempt++ {
+		result, err := streamClaudeOnce(ctx, run, send, onThinking)
+		if err == nil && result.Err != nil && run.resumeID != "" && !sent && ctx.Err() == nil {
+			run.dropResume()
+			continue
+		}
+		if err == nil && result.Err != nil && !sent && ctx.Err() == nil && run.fallBack(result.Err) {
+			attempt = -1
+			continue
+		}
+		if err != nil || result.Err == nil || sent || !shouldRetry(ctx, run, attempt, result.Err) {
+			run.endConversation(result, err)
+			return result, err
+		}
+	}
+}
+
+func streamClaudeOnce(ctx context.Context, run *claudeRun, onText, onThinking func(text string)) (claudeResult, error) {
+	// Hitting a stop sequence ends the run early without failing ctx
+	ctx, stopCLI := withShutdown(ctx)
+	defer stopCLI()
+
+	cmd := newClaudeCommand(ctx, run.args(true))
+	cmd.Dir = run.workdir
+	cmd.Stdin = strings.NewReader(run.cliInput)
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	var stderrLines *lineWriter
+	if run.onStderr != nil {
+		stderrLines = &lineWriter{fn: run.onStderr}
+		cmd.Stderr = io.MultiWriter(stderr, stderrLines)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		run.log.Errorf("Failed to create stdout pipe: %v", err)
+		return claudeResult{}, err
+	}
+
+	run.log.Infof("Processing streaming request (model: %s, system: %d chars, user: %d chars, transcription: %v)", run.Model, len(run.cliSystem), len(run.UserPrompt), run.transcription)
+	start := time.Now()
+
+	if err := cmd.Start(); err != nil {
+		run.log.Errorf("Failed to start Claude CLI: %v", err)
+		return claudeResult{}, startError(err)
+	}
+	defer trackProcess(cmd)()
+	// From here on the process is always waited for, even if a callback
+	// panics, so a run that ends early never leaves a zombie behind
+	waited := false
+	defer func() {
+		if !waited {
+			stopCLI()
+			cmd.Wait()
+		}
+	}()
+	run.timing.spawned(time.Since(start))
+	if run.onStart != nil {
+		run.onStart()
+	}
+
+	result := claudeResult{StopReason: "end_turn"}
+	var text strings.Builder
+	emitted := false
+	replied := false            // an assistant or result message arrived
+	var noise []string          // the first few non-JSON lines, to explain a run with no reply
+	sent := map[string]string{} // text already emitted per message/block
+
+	// All text goes through the stop matcher so a stop sequence is never
+	// forwarded, even when it arrives split across CLI messages, then is
+	// trimmed as a whole reply would be, and is cut off at max_tokens
+	matcher := newStopMatcher(run.Req.Stop)
+	trimmer := &spaceTrimmer{}
+	limit := &tokenCap{max: run.Req.maxTokens()}
+	ended := func() bool { return result.StopSequence != "" || limit.hit }
+	emit := func(t string) {
+		if ended() {
+			return
+		}
+		out, matched := matcher.Write(t)
+		if trimOutput {
+			out = trimmer.Write(out)
+		}
+		out, hit := limit.Write(out)
+		if hit && trimOutput {
+			out = strings.TrimRightFunc(out, unicode.IsSpace)
+		}
+		if out != "" {
+			text.WriteString(out)
+			onText(out)
+		}
+		switch {
+		case hit:
+			result.StopReason = "max_tokens"
+		case matched != "":
+			result.StopReason = "stop_sequence"
+			result.StopSequence = matched
+		}
+	}
+
+	// Lines grow as needed: a tool result or a long reply can make one
+	// message far bigger than any fixed buffer
+	reader := bufio.NewReaderSize(stdout, 64*1024)
+	var readErr error
+	for {
+		var line string
+		if line, readErr = readLine(reader, maxCLILineBytes); readErr != nil {
+			break
+		}
+		// The CLI is being killed (disconnect, timeout, shutdown); don't
+		// forward anything it managed to print in the meantime
+		if ctx.Err() != nil {
+			break
+		}
+		if line == "" {
+			continue
+		}
+
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			// Usually a warning or progress line, worth keeping in case
+			// the run produces nothing else
+			if looksLikeLogLine(line) {
+				run.log.Debugf("Skipping a log line in CLI output (%d bytes)", len(line))
+			} else {
+				run.log.Warnf("Skipping an unexpected non-JSON line in CLI output (%d bytes)", len(line))
+			}
+			run.log.Tracef("Non-JSON CLI output: %s", line)
+			if len(noise) < 3 {
+				noise = append(noise, sanitizeCLIOutput(line))
+			}
+			continue
+		}
+
+		msgType, _ := msg["type"].(string)
+		if sessionID, _ := msg["session_id"].(string); sessionID != "" {
+			result.SessionID = sessionID
+		}
+
+		if msgType == "assistant" || msgType == "result" {
+			replied = true
+		}
+		switch msgType {
+		case "assistant":
+			message, ok := msg["message"].(map[string]interface{})
+			if !ok {
+				break
+			}
+			if stopReason, _ := message["stop_reason"].(string); stopReason != "" {
+				result.StopReason = stopReason
+			}
+			// With schema 2 the text already arrived as stream_event deltas
+			if cliSchema == 2 {
+				break
+			}
+			msgID, _ := message["id"].(string)
+			content, _ := message["content"].([]interface{})
+			for i, c := range content {
+				// Only text blocks are part of the reply. Thinking goes to
+				// onThinking, if anything wants it; tool_use is skipped.
+				block, _ := c.(map[string]interface{})
+				key := fmt.Sprintf("%s/%d", msgID, i)
+				switch blockType, _ := block["type"].(string); blockType {
+				case "text":
+					t, _ := block["text"].(string)
+					if delta := blockDelta(sent, key, t); delta != "" {
+						emit(delta)
+						emitted = true
+					}
+				case "thinking":
+					t, _ := block["thinking"].(string)
+					if delta := blockDelta(sent, key, t); delta != "" && onThinking != nil {
+						onThinking(delta)
+					}
+				}
+			}
+
+		case "stream_event":
+			// Raw API events, only read with schema 2
+			if cliSchema != 2 {
+				break
+			}
+			switch kind, t := streamEventDelta(msg); {
+			case t == "":
+			case kind == "text":
+				emit(t)
+				emitted = true
+			case kind == "thinking" && onThinking != nil:
+				onThinking(t)
+			}
+
+		case "result":
+			var rm ClaudeStreamMessage
+			if json.Unmarshal([]byte(line), &rm) == nil && rm.Usage != nil {
+				result.Usage = rm.Usage
+			}
+			if rm.IsError {
+				run.log.Errorf("Claude CLI reported an error (%s): %.500s", rm.Subtype, rm.Result)
+				result.Err = fmt.Errorf("%s", sanitizeCLIOutput(rm.Result))
+			} else if r, ok := msg["result"].(string); ok && r != "" && !emitted {
+				// Fallback: send full result if we didn't get streaming content
+				emit(r)
+				emitted = true
+			}
+
+		case "system", "user":
+			// Session init and tool results: nothing for the client
+
+		default:
+			run.log.Debugf("Ignoring CLI message of type %q", msgType)
+		}
+
+		if result.StopSequence != "" {
+			run.log.Infof("Stop sequence %q matched, ending CLI run", result.StopSequence)
+			stopCLI()
+			break
+		}
+		if limit.hit {
+			run.log.Infof("Reached max_tokens (%d), ending CLI run", limit.max)
+			stopCLI()
+			break
+		}
+	}
+
+	if readErr != nil && readErr != io.EOF && result.Err == nil {
+		result.Err = fmt.Errorf("failed to read CLI output: %v", readErr)
+		// Nothing is draining stdout any more, so the CLI would block forever
+		stopCLI()
+	}
+
+	if !ended() {
+		tail := matcher.Flush()
+		if trimOutput {
+			tail = trimmer.Write(tail)
+		}
+		tail, hit := limit.Write(tail)
+		if hit && trimOutput {
+			tail = strings.TrimRightFunc(tail, unicode.IsSpace)
+		}
+		if tail != "" {
+			text.WriteString(tail)
+			onText(tail)
+		}
+		if hit {
+			result.StopReason = "max_tokens"
+		}
+	}
+
+	// A non-zero exit we didn't cause (stop sequence, timeout, disconnect)
+	// means the stream was cut short
+	err = cmd.Wait()
+	waited = true
+	if err != nil && result.Err == nil && ctx.Err() == nil {
+		run.log.Errorf("Stderr: %s", stderr.String())
+		result.Err = cliError(err, stderr.String())
+	}
+	if stderrLines != nil {
+		stderrLines.flush()
+	}
+	// A clean exit without a reply is a failure, not an empty answer
+	if !replied && result.Err == nil && ctx.Err() == nil {
+		result.Err = errors.New("the CLI produced no reply")
+		if len(noise) > 0 {
+			result.Err = fmt.Errorf("the CLI produced no reply, only: %s", strings.Join(noise, " | "))
+		}
+	}
+	elapsed := time.Since(start)
+	run.timing.generated(elapsed)
+	if result.Err != nil {
+		run.log.Errorf("Claude CLI failed mid-stream: %v", result.Err)
+	}
+	// Text cut off by the timeout is still a reply, ended as if it ran out
+	// of tokens
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && text.Len() > 0 {
+		result.TimedOut = true
+		result.StopReason = "max_tokens"
+		run.log.Warnf("Timed out after %v, ending the stream with %d chars of partial output", elapsed, text.Len())
+	}
+	run.log.With("duration_ms", elapsed.Milliseconds()).Infof("Streaming response completed in %v", elapsed)
+
+	result.Text = text.String()
+	run.checkBreakage(result.Text)
+	return result, nil
+}
+
+func handleNonStreamingRequest(ctx context.Context, w http.ResponseWriter, run *claudeRun) {
+	w.Header().Set("Content-Type", "application/json")
+
+	results, err := runClaudeN(ctx, run)
+	if clientGone(ctx, run) {
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		run.log.Errorf("Claude CLI timed out after %v", requestTimeout)
+		sendError(w, fmt.Sprintf("Claude CLI timed out after %v", requestTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errBusy) {
+		sendBusy(w, err, sendError)
+		return
+	}
+	if errors.Is(err, errCLIMissing) {
+		sendCLIMissing(w, sendError)
+		return
+	}
+	if err != nil {
+		sendRunFailure(w, err, sendError)
+		return
+	}
+
+	run.setResultHeaders(w)
+	resp := ChatResponse{
+		ID:                fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
+		Object:            "chat.completion",
+		Created:           time.Now().Unix(),
+		Model:             run.Model,
+		SystemFingerprint: run.fingerprint(),
+		Usage:             openAIUsage(w, run, results...),
+	}
+	for i, result := range results {
+		message, finishReason := run.reply(result)
+		resp.Choices = append(resp.Choices, Choice{
+			Index:        i,
+			Message:      &message,
+			FinishReason: &finishReason,
+		})
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runClaudeN runs the CLI once per requested choice (n), concurrently. Each
+// run waits for its own slot, so n never bypasses MAX_CONCURRENT. Any failure
+// fails the whole request.
+func runClaudeN(ctx context.Context, run *claudeRun) ([]claudeResult, error) {
+	n := run.choices()
+	results := make([]claudeResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = runClaude(ctx, run)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// blockDelta returns the part of a content block's text that hasn't been
+// emitted yet. Some CLI modes repeat a block with its text grown so far, so
+// only the appended suffix is new; text that doesn't extend what was sent is
+// treated as new in full.
+func blockDelta(sent map[string]string, key, text string) string {
+	prev := sent[key]
+	sent[key] = text
+	if strings.HasPrefix(text, prev) {
+		return text[len(prev):]
+	}
+	return text
+}
+
+// clientGone reports whether the client went away before the run finished,
+// or cancelled it through /v1/cancel. The CLI has already been killed by
+// then, since it is bound to the request context, so there is nothing left
+// to answer with (cancellable answers a cancelled request that got nothing).
+func clientGone(ctx context.Context, run *claudeRun) bool {
+	if ctx.Err() != context.Canceled {
+		return false
+	}
+	if errors.Is(context.Cause(ctx), errCancelled) {
+		run.log.Infof("Cancelled through /v1/cancel, CLI run stopped")
+		return true
+	}
+	run.log.Infof("Client disconnected, CLI run stopped")
+	return true
+}
+
+// findStop returns the index of the earliest stop sequence in text and the
+// sequence itself, or -1 if none occurs
+func findStop(text string, stops []string) (int, string) {
+	best, match := -1, ""
+	for _, seq := range stops {
+		if idx := strings.Index(text, seq); idx >= 0 && (best < 0 || idx < best) {
+			best, match = idx, seq
+		}
+	}
+	return best, match
+}
+
+// spaceTrimmer trims streamed text the way TRIM_OUTPUT trims a whole reply.
+// Leading whitespace is dropped, and trailing whitespace held back until
+// more text follows it, so it never reaches the client if nothing does.
+type spaceTrimmer struct {
+	started bool
+	held    string
+}
+
+func (t *spaceTrimmer) Write(s string) string {
+	if !t.started {
+		if s = strings.TrimLeftFunc(s, unicode.IsSpace); s == "" {
+			return ""
+		}
+		t.started = true
+	}
+	s = t.held + s
+	out := strings.TrimRightFunc(s, unicode.IsSpace)
+	t.held = s[len(out):]
+	return out
+}
+
+// stopMatcher finds stop sequences in streamed text. It holds back just
+// enough trailing text that a sequence split across chunks is never partly
+// emitted before we know whether it matches.
+type stopMatcher struct {
+	stops    []string
+	holdback int
+	pending  string
+}
+
+func newStopMatcher(stops []string) *stopMatcher {
+	m := &stopMatcher{stops: stops}
+	for _, seq := range stops {
+		if len(seq)-1 > m.holdback {
+			m.holdback = len(seq) - 1
+		}
+	}
+	return m
+}
+
+// Write adds text and returns the part that is safe to emit. If a stop
+// sequence matched, it is returned and nothing further should be written.
+func (m *stopMatcher) Write(text string) (string, string) {
+	m.pending += text
+	if idx, seq := findStop(m.pending, m.stops); idx >= 0 {
+		out := m.pending[:idx]
+		m.pending = ""
+		return out, seq
+	}
+	cut := len(m.pending) - m.holdback
+	// Never split a multi-byte character between chunks
+	for cut > 0 && cut < len(m.pending) && !utf8.RuneStart(m.pending[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		return "", ""
+	}
+	out := m.pending[:cut]
+	m.pending = m.pending[cut:]
+	return out, ""
+}
+
+// Flush returns whatever is still held back once the stream has ended
+func (m *stopMatcher) Flush() string {
+	out := m.pending
+	m.pending = ""
+	return out
+}
+
+// openAIFinishReason maps a CLI stop reason onto OpenAI's finish_reason
+func openAIFinishReason(stopReason string) string {
+	if stopReason == "max_tokens" {
+		return "length"
+	}
+	return "stop"
+}
+
+func handleStreamingRequest(ctx context.Context, w http.ResponseWriter, run *claudeRun) {
+	// Set SSE headers
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Trailer", "X-Usage-Source, X-Model-Used, X-Time-To-First-Token-Ms, X-Proxy-Timing")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	chatID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	// With n > 1 every choice streams from its own CLI run at the same time;
+	// chunks are interleaved and told apart by their choice index
+	n := run.choices()
+	var mu sync.Mutex
+	sentRole := make([]bool, n)
+	sentAny := false
+	// JSON can only be checked once a reply is complete, so in JSON mode the
+	// text is held back and sent at the end. With tools on offer, the text is
+	// streamed through a toolStreamer, which turns calls into deltas.
+	holdBack := run.Req.jsonMode()
+	held := make([]string, n)
+	tools := make([]*toolStreamer, n)
+	pings := newPinger(w, flusher, &mu)
+	run.onStart = pings.start
+	if run.debugStderr {
+		run.onStderr = pings.stderr
+	}
+
+	// sendDelta streams a delta for choice i, preceded by the role-only chunk
+	// the first time. Callers hold mu.
+	sendDelta := func(i int, delta Delta) {
+		if !sentRole[i] {
+			sendSSEChunk(w, flusher, ChatResponse{
+				ID:                chatID,
+				Object:            "chat.completion.chunk",
+				Created:           created,
+				Model:             run.Model,
+				SystemFingerprint: run.fingerprint(),
+				Choices: []Choice{{
+					Index: i,
+					Delta: &Delta{Role: "assistant"},
+				}},
+			})
+			sentRole[i] = true
+			sentAny = true
+		}
+		sendSSEChunk(w, flusher, ChatResponse{
+			ID:                chatID,
+			Object:            "chat.completion.chunk",
+			Created:           created,
+			Model:             run.Model,
+			SystemFingerprint: run.fingerprint(),
+			Choices: []Choice{{
+				Index: i,
+				Delta: &delta,
+			}},
+		})
+	}
+	// With INCLUDE_THINKING, Claude's reasoning streams as reasoning_content
+	onThinking := func(i int) func(string) {
+		if !includeThinking {
+			return nil
+		}
+		return func(text string) {
+			mu.Lock()
+			defer mu.Unlock()
+			sendDelta(i, Delta{ReasoningContent: text})
+		}
+	}
+	results := make([]claudeResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if run.Req.usesTools() && !holdBack {
+			choice := i
+			tools[i] = &toolStreamer{send: func(delta Delta) { sendDelta(choice, delta) }}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = streamClaude(ctx, run, func(text string) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case holdBack:
+					held[i] += text
+				case tools[i] != nil:
+					tools[i].Write(text)
+				default:
+					sendDelta(i, Delta{Content: text})
+				}
+			}, onThinking(i))
+		}(i)
+	}
+	wg.Wait()
+	if pings.stop() {
+		sentAny = true
+	}
+	// Whatever the tool streamers held back goes out once nothing else can
+	// write to the response
+	mu.Lock()
+	for _, t := range tools {
+		if t != nil {
+			t.Flush()
+		}
+	}
+	mu.Unlock()
+
+	var err, failed error
+	for i := range errs {
+		if err == nil {
+			err = errs[i]
+		}
+		if failed == nil {
+			failed = results[i].Err
+		}
+	}
+	if clientGone(ctx, run) {
+		return
+	}
+	if errors.Is(err, errBusy) && !sentAny {
+		// Nothing has been written yet, so this can still be a plain 429 (or 503)
+		w.Header().Set("Content-Type", "application/json")
+		sendBusy(w, err, sendError)
+		return
+	}
+	if errors.Is(err, errCLIMissing) && !sentAny {
+		w.Header().Set("Content-Type", "application/json")
+		sendCLIMissing(w, sendError)
+		return
+	}
+	if errors.Is(err, errBusy) {
+		sendSSEError(w, flusher, http.StatusTooManyRequests, "Too many concurrent requests, try again later")
+		return
+	}
+	if err != nil {
+		sendSSEError(w, flusher, http.StatusInternalServerError, "Failed to start Claude CLI")
+		return
+	}
+
+	// The deadline kills the process group, which closes stdout and ends the
+	// stream. If any choice got text out first, the stream ends normally with
+	// finish_reason "length"; otherwise it is an error.
+	partial := false
+	for _, result := range results {
+		partial = partial || result.TimedOut
+	}
+	if ctx.Err() == context.DeadlineExceeded && !partial {
+		run.log.Errorf("Streaming request timed out after %v", requestTimeout)
+		sendSSEError(w, flusher, http.StatusGatewayTimeout, fmt.Sprintf("Claude CLI timed out after %v", requestTimeout))
+		return
+	}
+
+	// JSON mode replies were held back, so a bad one is still caught in time
+	if run.Req.jsonMode() {
+		for i := range results {
+			if results[i].Err != nil {
+				continue
+			}
+			if held[i], results[i].Err = run.checkJSON(held[i]); results[i].Err != nil {
+				run.log.Errorf("Streamed reply is not valid JSON")
+				if failed == nil {
+					failed = results[i].Err
+				}
+			}
+		}
+	}
+
+	if failed != nil && !sentAny {
+		// Nothing has been sent, so this can still be a plain error
+		w.Header().Set("Content-Type", "application/json")
+		sendRunFailure(w, failed, sendError)
+		return
+	}
+
+	// Send final chunk with finish_reason for every choice; one that was cut
+	// short by a CLI failure finishes with "error"
+	for i, result := range results {
+		finishReason := openAIFinishReason(result.StopReason)
+		if holdBack {
+			result.Text = held[i]
+			var message Message
+			message, finishReason = run.reply(result)
+			sendSSEChunk(w, flusher, ChatResponse{
+				ID:                chatID,
+				Object:            "chat.completion.chunk",
+				Created:           created,
+				Model:             run.Model,
+				SystemFingerprint: run.fingerprint(),
+				Choices: []Choice{{
+					Index: i,
+					Delta: &Delta{Role: "assistant", Content: message.Content.Text, ToolCalls: streamedToolCalls(message.ToolCalls)},
+				}},
+			})
+		}
+		if tools[i] != nil && tools[i].calls > 0 {
+			finishReason = "tool_calls"
+			run.log.Infof("Claude made %d tool call(s)", tools[i].calls)
+		}
+		if result.Err != nil {
+			finishReason = "error"
+		}
+		sendSSEChunk(w, flusher, ChatResponse{
+			ID:                chatID,
+			Object:            "chat.completion.chunk",
+			Created:           created,
+			Model:             run.Model,
+			SystemFingerprint: run.fingerprint(),
+			Choices: []Choice{{
+				Index:        i,
+				Delta:        &Delta{},
+				FinishReason: &finishReason,
+			}},
+		})
+	}
+	if failed != nil {
+		msg, status := runFailure(failed)
+		sendSSEError(w, flusher, status, msg)
+		return
+	}
+
+	// OpenAI only reports usage in a stream when asked to, as one extra chunk
+	// with no choices right before [DONE]
+	run.setResultHeaders(w)
+	usage := openAIUsage(w, run, results...)
+	if usage != nil && run.Req.includeUsage() {
+		sendSSEChunk(w, flusher, ChatResponse{
+			ID:                chatID,
+			Object:            "chat.completion.chunk",
+			Created:           created,
+			Model:             run.Model,
+			SystemFingerprint: run.fingerprint(),
+			Choices:           []Choice{},
+			Usage:             usage,
+		})
+	}
+
+	// Send [DONE]
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+func sendSSEChunk(w http.ResponseWriter, flusher http.Flusher, chunk ChatResponse) {
+	data, _ := json.Marshal(chunk)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+}
+
+// sendSSEError ends a stream that already answered 200 with an error event.
+// It is OpenAI's error object, with the type and code status would have had
+// before the stream began, as a bare data line: the SDKs raise an API error
+// for any event carrying an "error" key instead of parsing it as a chunk.
+func sendSSEError(w http.ResponseWriter, flusher http.Flusher, status int, message string) {
+	errResp := ErrorResponse{}
+	errResp.Error.Message = message
+	errType, code := openAIErrorType(status)
+	errResp.Error.Type = errType
+	if code != "" {
+		errResp.Error.Code = &code
+	}
+	data, _ := json.Marshal(errResp)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// sendBusy rejects a request that couldn't get a CLI slot, using the error
+// writer of whichever API flavor the client speaks
+func sendBusy(w http.ResponseWriter, err error, send func(http.ResponseWriter, string, int)) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueTimeout.Seconds())+1))
+	if errors.Is(err, errQueueFull) {
+		send(w, "Server overloaded, request queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	send(w, "Too many concurrent requests, try again later", http.StatusTooManyRequests)
+}
+
+// openAIErrorType maps a status onto the error type and code OpenAI uses for
+// it; the SDKs branch on these to decide whether to retry
+func openAIErrorType(status int) (string, string) {
+	switch status {
+	case http.StatusUnauthorized:
+		return "authentication_error", "invalid_api_key"
+	case http.StatusForbidden:
+		return "permission_error", ""
+	case http.StatusTooManyRequests:
+		return "rate_limit_error", "rate_limit_exceeded"
+	case http.StatusGatewayTimeout:
+		return "api_error", "timeout"
+	}
+	if status >= 400 && status < 500 {
+		return "invalid_request_error", ""
+	}
+	return "api_error", ""
+}
+
+// sendRequestError rejects a request prepareRun refused. A model outside
+// ALLOWED_MODELS is a 403, everything else a 400; both are
+// invalid_request_error, as OpenAI reports an unavailable model. An
+// oversized prompt carries OpenAI's context_length_exceeded code.
+func sendRequestError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errModelNotAllowed) {
+		writeError(w, http.StatusForbidden, "invalid_request_error", "model_not_allowed", err.Error())
+		return
+	}
+	if errors.Is(err, errPromptTooLong) {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", err.Error())
+		return
+	}
+	if errors.Is(err, errHookFailed) {
+		sendError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	sendError(w, err.Error(), http.StatusBadRequest)
+}
+
+// runFailure is the message and status for a run that failed after it was
+// accepted: a 500, or a 502 if a hook failed rather than the CLI
+func runFailure(err error) (string, int) {
+	if errors.Is(err, errHookFailed) {
+		return err.Error(), http.StatusBadGateway
+	}
+	return "Claude CLI failed: " + err.Error(), http.StatusInternalServerError
+}
+
+// sendRunFailure rejects a request whose run failed, using the error writer
+// of whichever API flavor the client speaks
+func sendRunFailure(w http.ResponseWriter, err error, send func(http.ResponseWriter, string, int)) {
+	msg, status := runFailure(err)
+	send(w, msg, status)
+}
+
+// sendError writes an OpenAI error with the type and code that fit status
+func sendError(w http.ResponseWriter, message string, status int) {
+	errType, code := openAIErrorType(status)
+	writeError(w, status, errType, code, message)
+}
+
+// writeError writes an OpenAI error with an explicit type and optional code
+func writeError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.WriteHeader(status)
+	resp := ErrorResponse{}
+	resp.Error.Message = message
+	resp.Error.Type = errType
+	if code != "" {
+		resp.Error.Code = &code
+	}
 	json.NewEncoder(w).Encode(resp)
 }
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testKey = "test-key"
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// setupProxy puts the settings main would read from the environment back to
+// their defaults, with testdata/fake-claude standing in for the CLI. Tests
+// change what they need afterwards. The fake CLI is a shell script, so tests
+// that run it are skipped on Windows.
+func setupProxy(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake CLI is a shell script")
+	}
+	bin, err := filepath.Abs("testdata/fake-claude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claudeBin = bin
+	if argTemplate, _, err = parseArgTemplate(defaultArgTemplate); err != nil {
+		t.Fatal(err)
+	}
+	apiKey = testKey
+	defaultModel = "sonnet"
+	requestTimeout = 10 * time.Second
+	queueTimeout = 5 * time.Second
+	cliSlots = make(chan struct{}, 4)
+	maxQueueDepth = 0
+	maxBodyBytes = 10 << 20
+	maxChoices = 4
+	cliMaxRetries = 0
+	cliSchema = 1
+	outputFormat = "json"
+	usageMode = "cli"
+	historyMode = "transcript"
+	systemPolicy = "inline"
+	trimOutput = true
+	includeThinking = false
+	pingInterval = 0
+	streamBatch = 0
+	preHook, postHook = nil, nil
+	hookFailOpen = false
+	modelAliases, modelDefaults, allowedModels = nil, nil, nil
+	proxySystemPrompt = ""
+	cache, conversations = nil, nil
+	limiter, userLimiter, ipLimiter = nil, nil, nil
+	allowNets, denyNets = nil, nil
+	trustProxy, trustedProxies = false, nil
+}
+
+// fakeOutput has the fake CLI print lines, as stream-json output when stream
+// is set and as its reply otherwise
+func fakeOutput(t *testing.T, stream bool, lines ...string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "output")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if stream {
+		t.Setenv("FAKE_CLAUDE_STREAM", path)
+	} else {
+		t.Setenv("FAKE_CLAUDE_OUTPUT", path)
+	}
+}
+
+// jsonLine encodes v as one line of CLI output
+func jsonLine(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// postJSON serves a request to handler the way the proxy would, with the
+// test key
+func postJSON(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testKey)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// sseData returns the data of each event in an SSE stream, in order
+func sseData(t *testing.T, body string) []string {
+	t.Helper()
+	var events []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	return events
+}
+
+// streamChunks decodes a chat completion stream's chunks, up to [DONE]
+func streamChunks(t *testing.T, body string) []ChatResponse {
+	t.Helper()
+	var chunks []ChatResponse
+	for _, data := range sseData(t, body) {
+		if data == "[DONE]" {
+			return chunks
+		}
+		var chunk ChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("bad chunk %s: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	t.Fatalf("stream did not end with [DONE]:\n%s", body)
+	return nil
+}
+
+// TestMaxTokens checks that max_tokens and max_completion_tokens each cut the
+// reply off, and that max_completion_tokens wins when both are set
+func TestMaxTokens(t *testing.T) {
+	const reply = "one two three four five six"
+	for _, tt := range []struct {
+		name   string
+		limits string
+		want   string
+		finish string
+	}{
+		{"max_tokens", `"max_tokens": 4`, "one two three", "length"},
+		{"max_completion_tokens", `"max_completion_tokens": 4`, "one two three", "length"},
+		{"both, completion lower", `"max_tokens": 100, "max_completion_tokens": 2`, "one two", "length"},
+		{"both, completion higher", `"max_tokens": 2, "max_completion_tokens": 100`, reply, "stop"},
+	} {
+		for _, stream := range []bool{false, true} {
+			name := tt.name
+			if stream {
+				name += " streaming"
+			}
+			t.Run(name, func(t *testing.T) {
+				setupProxy(t)
+				if stream {
+					fakeOutput(t, true,
+						jsonLine(t, map[string]interface{}{"type": "assistant", "message": map[string]interface{}{
+							"content": []map[string]string{{"type": "text", "text": reply}}}}),
+						jsonLine(t, map[string]interface{}{"type": "result", "subtype": "success", "result": reply}))
+				} else {
+					fakeOutput(t, false, jsonLine(t, map[string]interface{}{"type": "result", "subtype": "success", "result": reply}))
+				}
+
+				body := fmt.Sprintf(`{"model": "sonnet", "stream": %v, %s, "messages": [{"role": "user", "content": "Count"}]}`, stream, tt.limits)
+				w := postJSON(handleChat, "/v1/chat/completions", body)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				var text, finish string
+				if stream {
+					for _, chunk := range streamChunks(t, w.Body.String()) {
+						for _, choice := range chunk.Choices {
+							if choice.Delta != nil {
+								text += choice.Delta.Content
+							}
+							if choice.FinishReason != nil {
+								finish = *choice.FinishReason
+							}
+						}
+					}
+				} else {
+					var resp ChatResponse
+					if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+						t.Fatal(err)
+					}
+					text, finish = resp.Choices[0].Message.Content.Text, *resp.Choices[0].FinishReason
+				}
+				if text != tt.want || finish != tt.finish {
+					t.Errorf("got %q with finish_reason %s, want %q with %s", text, finish, tt.want, tt.finish)
+				}
+			})
+		}
+	}
+}
+
+// TestCLISlots sends more requests at once than there are CLI slots, and
+// checks no more than MAX_CONCURRENT CLI processes ever run together
+func TestCLISlots(t *testing.T) {
+	setupProxy(t)
+	const slots = 3
+	cliSlots = make(chan struct{}, slots)
+	pids := t.TempDir()
+	t.Setenv("FAKE_CLAUDE_PIDS", pids)
+	t.Setenv("FAKE_CLAUDE_SLEEP", "0.3")
+
+	done := make(chan struct{})
+	most := make(chan int)
+	go func() {
+		max := 0
+		for {
+			entries, _ := os.ReadDir(pids)
+			if len(entries) > max {
+				max = len(entries)
+			}
+			select {
+			case <-done:
+				most <- max
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	codes := make([]int, slots+5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "messages": [{"role": "user", "content": "Hi"}]}`)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+
+	if max := <-most; max == 0 || max > slots {
+		t.Errorf("saw up to %d CLI processes at once, want between 1 and %d", max, slots)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: status %d", i, code)
+		}
+	}
+}
+
+// TestBlockDelta feeds blockDelta a block repeated with its text growing, as
+// some CLI modes send it, and checks the deltas add up to the final text
+// without repeating any of it
+func TestBlockDelta(t *testing.T) {
+	events := []struct{ key, text, delta string }{
+		{"msg_1:0", "Hel", "Hel"},
+		{"msg_1:0", "Hello", "lo"},
+		{"msg_1:0", "Hello", ""},
+		{"msg_1:1", "Second", "Second"},
+		{"msg_1:0", "Hello, wor", ", wor"},
+		{"msg_1:1", "Second block", " block"},
+		{"msg_1:0", "Hello, world", "ld"},
+	}
+	sent := map[string]string{}
+	got := map[string]string{}
+	for i, e := range events {
+		delta := blockDelta(sent, e.key, e.text)
+		if delta != e.delta {
+			t.Errorf("event %d: delta %q, want %q", i, delta, e.delta)
+		}
+		got[e.key] += delta
+	}
+	if got["msg_1:0"] != "Hello, world" || got["msg_1:1"] != "Second block" {
+		t.Errorf("deltas add up to %q", got)
+	}
+}
+
+// TestStreamCumulativeBlocks streams CLI output that repeats the assistant
+// message as it grows, and checks the client gets each piece of text once
+func TestStreamCumulativeBlocks(t *testing.T) {
+	setupProxy(t)
+	var lines []string
+	for _, text := range []string{"The answer", "The answer is", "The answer is", "The answer is 42."} {
+		lines = append(lines, jsonLine(t, map[string]interface{}{"type": "assistant", "message": map[string]interface{}{
+			"id": "msg_1", "content": []map[string]string{{"type": "text", "text": text}}}}))
+	}
+	lines = append(lines, jsonLine(t, map[string]interface{}{"type": "result", "subtype": "success", "result": "The answer is 42."}))
+	fakeOutput(t, true, lines...)
+
+	w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "stream": true, "messages": [{"role": "user", "content": "What is the answer?"}]}`)
+	var deltas []string
+	for _, chunk := range streamChunks(t, w.Body.String()) {
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil && choice.Delta.Content != "" {
+				deltas = append(deltas, choice.Delta.Content)
+			}
+		}
+	}
+	if got := strings.Join(deltas, ""); got != "The answer is 42." {
+		t.Errorf("deltas %q add up to %q", deltas, got)
+	}
+	if want := []string{"The answer", " is", " 42."}; fmt.Sprint(deltas) != fmt.Sprint(want) {
+		t.Errorf("deltas = %q, want %q", deltas, want)
+	}
+}
+
+// TestDegenerateRequests checks requests with nothing to answer get a 400
+// saying why, without the CLI being run
+func TestDegenerateRequests(t *testing.T) {
+	for _, tt := range []struct {
+		name, path, body, want string
+	}{
+		{"empty body", "/v1/chat/completions", "", "Request body is empty"},
+		{"blank body", "/v1/chat/completions", " \n ", "Request body is empty"},
+		{"no messages", "/v1/chat/completions", `{"model": "sonnet", "messages": []}`, "messages must not be empty"},
+		{"system only", "/v1/chat/completions", `{"model": "sonnet", "messages": [{"role": "system", "content": "Be brief."}]}`,
+			"messages must include at least one user message with content"},
+		{"blank user message", "/v1/chat/completions", `{"model": "sonnet", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "  "}]}`,
+			"messages must include at least one user message with content"},
+		{"empty body", "/v1/messages", "", "Request body is empty"},
+		{"no messages", "/v1/messages", `{"model": "sonnet", "max_tokens": 100, "system": "Be brief.", "messages": []}`,
+			"messages must include at least one user message with content"},
+	} {
+		t.Run(strings.TrimPrefix(tt.path, "/v1/")+" "+tt.name, func(t *testing.T) {
+			setupProxy(t)
+			pids := t.TempDir()
+			t.Setenv("FAKE_CLAUDE_PIDS", pids)
+			handler := handleChat
+			if tt.path == "/v1/messages" {
+				handler = handleMessages
+			}
+
+			w := postJSON(handler, tt.path, tt.body)
+			var resp struct {
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != http.StatusBadRequest || resp.Error.Message != tt.want {
+				t.Errorf("got %d %s, want 400 with %q", w.Code, w.Body, tt.want)
+			}
+			if entries, _ := os.ReadDir(pids); len(entries) > 0 {
+				t.Errorf("the CLI was run")
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// TestStreamGolden compares a whole chat completion stream, byte for byte,
+// with testdata/stream/hello.golden. Run with -update to rewrite it.
+func TestStreamGolden(t *testing.T) {
+	setupProxy(t)
+	t.Setenv("FAKE_CLAUDE_STREAM", filepath.Join("testdata", "stream", "hello.jsonl"))
+
+	w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "stream": true, "stream_options": {"include_usage": true},
+		"messages": [{"role": "user", "content": "Say hello"}]}`)
+	body := w.Body.String()
+
+	// Every chunk shares the stream's ID and creation time, which change from
+	// run to run, so they are checked here and pinned for the comparison
+	ids := regexp.MustCompile(`"id":"chatcmpl-\d+"`).FindAllString(body, -1)
+	created := regexp.MustCompile(`"created":\d+`).FindAllString(body, -1)
+	if len(ids) == 0 || len(ids) != len(created) {
+		t.Fatalf("%d IDs and %d creation times in:\n%s", len(ids), len(created), body)
+	}
+	for i := range ids {
+		if ids[i] != ids[0] || created[i] != created[0] {
+			t.Fatalf("chunk %d has %s %s, the first %s %s", i, ids[i], created[i], ids[0], created[0])
+		}
+	}
+	body = strings.ReplaceAll(body, ids[0], `"id":"chatcmpl-0"`)
+	body = strings.ReplaceAll(body, created[0], `"created":0`)
+
+	golden := filepath.Join("testdata", "stream", "hello.golden")
+	if *update {
+		if err := os.WriteFile(golden, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != string(want) {
+		t.Errorf("stream differs from %s:\n%s", golden, body)
+	}
+}
+
+// TestBodyTooLarge checks a body over MAX_BODY_BYTES gets a 413 before it is
+// parsed, whether it arrives that large or only grows so when decompressed
+func TestBodyTooLarge(t *testing.T) {
+	setupProxy(t)
+	maxBodyBytes = 1024
+	pids := t.TempDir()
+	t.Setenv("FAKE_CLAUDE_PIDS", pids)
+	body := `{"model": "sonnet", "messages": [{"role": "user", "content": "` + strings.Repeat("a", 2048) + `"}]}`
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte(body))
+	zw.Close()
+	if zipped.Len() > int(maxBodyBytes) {
+		t.Fatalf("gzipped body is %d bytes, meant to fit the limit", zipped.Len())
+	}
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{"plain", []byte(body), ""},
+		{"gzip", zipped.Bytes(), "gzip"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+testKey)
+			req.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			handleChat(w, req)
+			if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "Request body exceeds 1024 bytes") {
+				t.Errorf("got %d %s, want 413", w.Code, w.Body)
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(pids); len(entries) > 0 {
+		t.Errorf("the CLI was run")
+	}
+
+	if w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "messages": [{"role": "user", "content": "Hi"}]}`); w.Code != http.StatusOK {
+		t.Errorf("a body under the limit got %d %s", w.Code, w.Body)
+	}
+}
+
+// TestAuthHeaders checks the API key is accepted in each header and form
+// clients send it in, and refused otherwise
+func TestAuthHeaders(t *testing.T) {
+	setupProxy(t)
+	for _, tt := range []struct {
+		name, header, value string
+		ok                  bool
+	}{
+		{"bearer", "Authorization", "Bearer test-key", true},
+		{"lower case scheme", "Authorization", "bearer test-key", true},
+		{"upper case scheme", "Authorization", "BEARER test-key", true},
+		{"lower case header", "authorization", "Bearer test-key", true},
+		{"extra spaces", "Authorization", "  Bearer   test-key  ", true},
+		{"tab", "Authorization", "Bearer\ttest-key", true},
+		{"x-api-key", "X-Api-Key", "test-key", true},
+		{"lower case x-api-key", "x-api-key", " test-key ", true},
+		{"wrong key", "Authorization", "Bearer other-key", false},
+		{"key prefix", "Authorization", "Bearer test-ke", false},
+		{"no scheme", "Authorization", "test-key", false},
+		{"basic scheme", "Authorization", "Basic test-key", false},
+		{"empty bearer", "Authorization", "Bearer ", false},
+		{"empty x-api-key", "X-Api-Key", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model": "sonnet", "messages": [{"role": "user", "content": "Hi"}]}`))
+			req.Header.Set(tt.header, tt.value)
+			w := httptest.NewRecorder()
+			handleChat(w, req)
+			if ok := w.Code != http.StatusUnauthorized; ok != tt.ok {
+				t.Errorf("%s: %q got %d, want accepted %v", tt.header, tt.value, w.Code, tt.ok)
+			}
+		})
+	}
+}
+
+// TestSystemMessagePolicies builds prompts from a conversation with system
+// messages before, between and after its turns, under each
+// SYSTEM_MESSAGE_POLICY
+func TestSystemMessagePolicies(t *testing.T) {
+	text := func(role, content string) Message { return Message{Role: role, Content: MessageContent{Text: content}} }
+	messages := []Message{
+		text("system", "Be brief."),
+		text("developer", "No markdown."),
+		text("user", "Hi"),
+		text("assistant", "Hello!"),
+		text("system", "Answer in French."),
+		text("user", "How are you?"),
+		text("system", "Sign off with your name."),
+	}
+	for _, tt := range []struct {
+		policy string
+		system string
+		turns  []turn
+	}{
+		{"inline", "Be brief.\n\nNo markdown.", []turn{
+			{"user", "Hi"},
+			{"assistant", "Hello!"},
+			{"system", "Answer in French."},
+			{"user", "How are you?"},
+			{"system", "Sign off with your name."},
+		}},
+		{"hoist", "Be brief.\n\nNo markdown.\n\nAnswer in French.\n\nSign off with your name.", []turn{
+			{"user", "Hi"},
+			{"assistant", "Hello!"},
+			{"user", "How are you?"},
+		}},
+		{"fold", "Be brief.\n\nNo markdown.", []turn{
+			{"user", "Hi"},
+			{"assistant", "Hello!"},
+			{"user", "Answer in French.\n\nHow are you?\n\nSign off with your name."},
+		}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			setupProxy(t)
+			systemPolicy = tt.policy
+			system, user := buildPrompts(messages)
+			if system != tt.system {
+				t.Errorf("system prompt = %q, want %q", system, tt.system)
+			}
+			if want := formatTranscript(tt.turns); user != want {
+				t.Errorf("transcript =\n%s\nwant\n%s", user, want)
+			}
+		})
+	}
+	if messages[5].Content.Text != "How are you?" {
+		t.Errorf("the request's messages were changed: %q", messages[5].Content.Text)
+	}
+}
+
+// TestTrimOutput checks TRIM_OUTPUT strips the whitespace around a reply
+// when on, and leaves it exactly as the CLI wrote it when off, whether the
+// reply is streamed or not
+func TestTrimOutput(t *testing.T) {
+	const reply = "\n    return a + b\n\n"
+	for _, trim := range []bool{true, false} {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("trim=%v stream=%v", trim, stream), func(t *testing.T) {
+				setupProxy(t)
+				trimOutput = trim
+				result := jsonLine(t, map[string]interface{}{"type": "result", "subtype": "success", "result": reply})
+				if stream {
+					fakeOutput(t, true,
+						jsonLine(t, map[string]interface{}{"type": "assistant", "message": map[string]interface{}{
+							"id": "msg_1", "content": []map[string]string{{"type": "text", "text": "\n    return"}}}}),
+						jsonLine(t, map[string]interface{}{"type": "assistant", "message": map[string]interface{}{
+							"id": "msg_1", "content": []map[string]string{{"type": "text", "text": reply}}}}),
+						result)
+				} else {
+					fakeOutput(t, false, result)
+				}
+
+				w := postJSON(handleChat, "/v1/chat/completions", fmt.Sprintf(`{"model": "sonnet", "stream": %v,
+					"messages": [{"role": "user", "content": "def add(a, b):"}]}`, stream))
+				var text string
+				if stream {
+					for _, chunk := range streamChunks(t, w.Body.String()) {
+						for _, choice := range chunk.Choices {
+							if choice.Delta != nil {
+								text += choice.Delta.Content
+							}
+						}
+					}
+				} else {
+					var resp ChatResponse
+					if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+						t.Fatalf("%v: %s", err, w.Body)
+					}
+					text = resp.Choices[0].Message.Content.Text
+				}
+				want := reply
+				if trim {
+					want = strings.TrimSpace(reply)
+				}
+				if text != want {
+					t.Errorf("got %q, want %q", text, want)
+				}
+			})
+		}
+	}
+}
+
+// TestStreamErrorBytes pins the exact bytes of an auth failure reported
+// before a stream starts, as a plain error, and once it has, as an error
+// event: the error object must be the same in both
+func TestStreamErrorBytes(t *testing.T) {
+	const badKey = `{"error":{"message":"Invalid API key","type":"authentication_error","param":null,"code":"invalid_api_key"}}`
+	const cliLogin = `{"error":{"message":"Claude CLI failed: exit status 1: Invalid API key · Please run /login","type":"api_error","param":null,"code":null}}`
+	request := `{"model": "sonnet", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`
+
+	t.Run("proxy key", func(t *testing.T) {
+		setupProxy(t)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(request))
+		req.Header.Set("Authorization", "Bearer wrong-key")
+		w := httptest.NewRecorder()
+		handleChat(w, req)
+		if w.Code != http.StatusUnauthorized || w.Body.String() != badKey+"\n" {
+			t.Errorf("before the stream: %d %q", w.Code, w.Body)
+		}
+
+		w = httptest.NewRecorder()
+		sendSSEError(w, w, http.StatusUnauthorized, "Invalid API key")
+		if want := "data: " + badKey + "\n\ndata: [DONE]\n\n"; w.Body.String() != want {
+			t.Errorf("in the stream: %q, want %q", w.Body, want)
+		}
+	})
+
+	t.Run("CLI login", func(t *testing.T) {
+		setupProxy(t)
+		t.Setenv("FAKE_CLAUDE_FAIL", "Invalid API key · Please run /login")
+		w := postJSON(handleChat, "/v1/chat/completions", request)
+		if w.Code != http.StatusInternalServerError || w.Body.String() != cliLogin+"\n" {
+			t.Errorf("before the stream: %d %q", w.Code, w.Body)
+		}
+
+		fakeOutput(t, true, jsonLine(t, map[string]interface{}{"type": "assistant", "message": map[string]interface{}{
+			"id": "msg_1", "content": []map[string]string{{"type": "text", "text": "Hel"}}}}))
+		w = postJSON(handleChat, "/v1/chat/completions", request)
+		events := sseData(t, w.Body.String())
+		if w.Code != http.StatusOK || len(events) < 3 {
+			t.Fatalf("in the stream: %d %q", w.Code, w.Body)
+		}
+		if !strings.HasSuffix(w.Body.String(), "\n\ndata: "+cliLogin+"\n\ndata: [DONE]\n\n") {
+			t.Errorf("in the stream: %q, want it to end with the error and [DONE]", w.Body)
+		}
+		if !strings.Contains(events[len(events)-3], `"finish_reason":"error"`) {
+			t.Errorf("last chunk %s doesn't finish with error", events[len(events)-3])
+		}
+	})
+}
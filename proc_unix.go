@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group so that
+// killProcessGroup can take down anything the CLI spawned, not just the CLI.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup sends SIGKILL to every process in the command's group
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// warnIfInit warns when the proxy is PID 1, as in a container started
+// without an init. The proxy waits for every CLI it starts, but processes the
+// CLI leaves behind, including those killed with its group, are reparented
+// to PID 1 and would never be reaped.
+func warnIfInit() {
+	if os.Getpid() == 1 {
+		logger.Warnf("Running as PID 1: orphaned CLI subprocesses won't be reaped and will pile up as zombies; run the container with an init, such as docker run --init")
+	}
+}
@@ -0,0 +1,146 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForPIDs waits for the fake CLI to have started n runs, and returns
+// their PIDs
+func waitForPIDs(t *testing.T, dir string, n int) []int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) >= n {
+			var pids []int
+			for _, e := range entries {
+				pid, err := strconv.Atoi(e.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				pids = append(pids, pid)
+			}
+			return pids
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d CLI runs started", len(entries), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitGone waits for a process to be both dead and waited for. A zombie still
+// answers signal 0, so one nobody waited for fails this too.
+func waitGone(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("CLI process %d is still there", pid)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestClientDisconnectKillsCLI has a client give up on a slow request, and
+// checks the proxy kills the CLI run serving it
+func TestClientDisconnectKillsCLI(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run("stream="+strconv.FormatBool(stream), func(t *testing.T) {
+			setupProxy(t)
+			pids := t.TempDir()
+			t.Setenv("FAKE_CLAUDE_PIDS", pids)
+			t.Setenv("FAKE_CLAUDE_SLEEP", "30")
+			server := httptest.NewServer(http.HandlerFunc(handleChat))
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			body := `{"model": "sonnet", "stream": ` + strconv.FormatBool(stream) + `, "messages": [{"role": "user", "content": "Hi"}]}`
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+testKey)
+			errs := make(chan error, 1)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				errs <- err
+			}()
+
+			pid := waitForPIDs(t, pids, 1)[0]
+			cancel()
+			if err := <-errs; !errors.Is(err, context.Canceled) {
+				t.Errorf("client got %v, want it cancelled", err)
+			}
+			waitGone(t, pid)
+			if _, err := os.Stat(filepath.Join(pids, strconv.Itoa(pid))); err != nil {
+				t.Errorf("CLI run finished by itself rather than being killed: %v", err)
+			}
+		})
+	}
+}
+
+// TestCancelledRunsLeaveNoZombies starts and cancels many CLI runs, streamed
+// and not, and checks every one is killed and waited for, so nothing piles
+// up however many clients give up
+func TestCancelledRunsLeaveNoZombies(t *testing.T) {
+	setupProxy(t)
+	const rounds, perRound = 3, 10
+	cliSlots = make(chan struct{}, perRound)
+	t.Setenv("FAKE_CLAUDE_SLEEP", "30")
+
+	for round := 0; round < rounds; round++ {
+		pids := t.TempDir()
+		t.Setenv("FAKE_CLAUDE_PIDS", pids)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{}, perRound)
+		for i := 0; i < perRound; i++ {
+			body := `{"model": "sonnet", "stream": ` + strconv.FormatBool(i%2 == 0) + `, "messages": [{"role": "user", "content": "Hi"}]}`
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)).WithContext(ctx)
+			req.Header.Set("Authorization", "Bearer "+testKey)
+			go func() {
+				handleChat(httptest.NewRecorder(), req)
+				done <- struct{}{}
+			}()
+		}
+
+		started := waitForPIDs(t, pids, perRound)
+		cancel()
+		for i := 0; i < perRound; i++ {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("round %d: a handler didn't return after its request was cancelled", round)
+			}
+		}
+		for _, pid := range started {
+			waitGone(t, pid)
+		}
+		liveProcesses.Lock()
+		live := len(liveProcesses.byPID)
+		liveProcesses.Unlock()
+		if live != 0 {
+			t.Fatalf("round %d: %d CLI processes still tracked", round, live)
+		}
+		if len(cliSlots) != 0 {
+			t.Fatalf("round %d: %d CLI slots still taken", round, len(cliSlots))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is an in-memory token bucket per API key. Each bucket holds up
+// to a minute's worth of requests and refills continuously, so a client can
+// burst up to RATE_LIMIT_RPM and then sustain that rate.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rpm     int
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is nil when RATE_LIMIT_RPM is unset, userLimiter when
+// USER_RATE_LIMIT_RPM is, and ipLimiter when IP_RATE_LIMIT_RPM is
+var limiter, userLimiter, ipLimiter *rateLimiter
+
+// rateLimiters returns the limiters in force, which a reload may replace
+func rateLimiters() (key, user, ip *rateLimiter) {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return limiter, userLimiter, ipLimiter
+}
+
+func newRateLimiter(rpm int) *rateLimiter {
+	return &rateLimiter{rpm: rpm, buckets: map[string]*bucket{}}
+}
+
+// take spends a token for key. It returns whether the request may proceed,
+// how many requests remain right now, and how long until the next token.
+func (l *rateLimiter) take(key string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perSecond := float64(l.rpm) / 60
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rpm), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.rpm), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// sweep drops buckets that have refilled completely: a new bucket starts
+// full, so forgetting them changes nothing. It returns how many it dropped.
+func (l *rateLimiter) sweep() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*float64(l.rpm)/60 >= float64(l.rpm) {
+			delete(l.buckets, key)
+			n++
+		}
+	}
+	return n
+}
+
+// rateLimited enforces RATE_LIMIT_RPM on an endpoint that runs the CLI. It
+// runs before the handler, so a rejected request never spawns a process.
+// Unauthenticated requests pass through to get the handler's 401, and other
+// methods than POST to get its 405, without spending a token.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		limiter, _, _ := rateLimiters()
+		if limiter == nil {
+			if allowIP(w, r) {
+				next(w, r)
+			}
+			return
+		}
+
+		ok, remaining, wait := limiter.take(key)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.rpm))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if ok {
+			if allowIP(w, r) {
+				next(w, r)
+			}
+			return
+		}
+
+		loggerFrom(r.Context()).Warnf("Rate limit of %d requests/minute exceeded", limiter.rpm)
+		sendRateLimited(w, r, wait, "Rate limit exceeded, try again later")
+	}
+}
+
+// allowUser enforces USER_RATE_LIMIT_RPM on the end user a request names in
+// OpenAI's user field (metadata.user_id on /v1/messages), apart from the
+// per-key limit. Requests naming no user only count against their key. A
+// rejected request has had its 429 written.
+func allowUser(w http.ResponseWriter, r *http.Request, user string) bool {
+	_, userLimiter, _ := rateLimiters()
+	if userLimiter == nil || user == "" {
+		return true
+	}
+	ok, _, wait := userLimiter.take(keyLabel(requestKey(r)) + "/" + user)
+	if ok {
+		return true
+	}
+	loggerFrom(r.Context()).Warnf("Rate limit of %d requests/minute exceeded for user %q", userLimiter.rpm, user)
+	sendRateLimited(w, r, wait, "Rate limit exceeded for this user, try again later")
+	return false
+}
+
+// allowIP enforces IP_RATE_LIMIT_RPM on the client address, as clientIP
+// finds it, so clients sharing the proxy's key can't starve each other.
+// Unix socket clients have no address and aren't limited. A rejected request
+// has had its 429 written.
+func allowIP(w http.ResponseWriter, r *http.Request) bool {
+	_, _, ipLimiter := rateLimiters()
+	if ipLimiter == nil {
+		return true
+	}
+	ip := clientIP(r)
+	if ip == nil {
+		return true
+	}
+	ok, _, wait := ipLimiter.take(ip.String())
+	if ok {
+		return true
+	}
+	loggerFrom(r.Context()).Warnf("Rate limit of %d requests/minute exceeded for client %s", ipLimiter.rpm, ip)
+	sendRateLimited(w, r, wait, "Rate limit exceeded for this client, try again later")
+	return false
+}
+
+// sendRateLimited writes a 429 telling the client when to retry, in the
+// shape of whichever API it called
+func sendRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if r.URL.Path == "/v1/messages" {
+		sendAnthropicError(w, message, http.StatusTooManyRequests)
+	} else {
+		sendError(w, message, http.StatusTooManyRequests)
+	}
+}
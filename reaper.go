@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// reaperInterval is how often the reaper runs, from REAPER_INTERVAL; 0
+// turns it off
+var reaperInterval = 5 * time.Minute
+
+// liveProcesses are the CLI processes running right now, by PID
+var liveProcesses = struct {
+	sync.Mutex
+	byPID map[int]*liveProcess
+}{byPID: map[int]*liveProcess{}}
+
+type liveProcess struct {
+	cmd     *exec.Cmd
+	started time.Time
+}
+
+// trackProcess registers a started CLI process until the returned func is
+// called, once it has been waited for
+func trackProcess(cmd *exec.Cmd) func() {
+	pid := cmd.Process.Pid
+	liveProcesses.Lock()
+	liveProcesses.byPID[pid] = &liveProcess{cmd: cmd, started: time.Now()}
+	liveProcesses.Unlock()
+	return func() {
+		liveProcesses.Lock()
+		delete(liveProcesses.byPID, pid)
+		liveProcesses.Unlock()
+	}
+}
+
+// reap runs every REAPER_INTERVAL for the life of the proxy, so a proxy that
+// runs for months doesn't slowly fill up with state nothing looks at again
+func reap() {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reapOnce()
+	}
+}
+
+// reapOnce drops expired conversation sessions and response cache entries
+// and idle rate limit buckets, which are otherwise only cleaned up when
+// touched. It also kills any CLI process still running well past
+// CLAUDE_TIMEOUT: its request should have killed it, so it is orphaned.
+func reapOnce() {
+	sessions, entries, buckets := 0, 0, 0
+	if conversations != nil {
+		sessions = conversations.sweep()
+	}
+	if cache != nil {
+		entries = cache.sweep()
+	}
+	key, user, ip := rateLimiters()
+	for _, l := range []*rateLimiter{key, user, ip} {
+		if l != nil {
+			buckets += l.sweep()
+		}
+	}
+
+	orphans := 0
+	limit := requestTimeout + time.Minute
+	liveProcesses.Lock()
+	for pid, p := range liveProcesses.byPID {
+		if age := time.Since(p.started); age > limit {
+			logger.Warnf("Reaper: CLI process %d has run for %v, past CLAUDE_TIMEOUT; killing it", pid, age.Round(time.Second))
+			if err := killProcessGroup(p.cmd); err != nil {
+				logger.Errorf("Reaper: killing CLI process %d: %v", pid, err)
+			}
+			orphans++
+		}
+	}
+	live := len(liveProcesses.byPID)
+	liveProcesses.Unlock()
+
+	log := logger.With("sessions", sessions, "cache_entries", entries, "rate_limit_buckets", buckets, "orphans", orphans, "cli_processes", live)
+	if sessions+entries+buckets+orphans == 0 {
+		log.Debugf("Reaper: nothing to clean up, %d CLI processes running", live)
+		return
+	}
+	log.Infof("Reaper: removed %d expired sessions, %d expired cache entries and %d idle rate limit buckets; killed %d orphaned CLI processes",
+		sessions, entries, buckets, orphans)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversationStore maps client conversation ids (X-Conversation-Id) onto
+// CLI sessions, so a follow-up turn can --resume the session and send only
+// the new messages instead of replaying the whole history
+type conversationStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*cliSession
+}
+
+// cliSession is the CLI session behind a conversation and what it has seen
+type cliSession struct {
+	ID       string // the CLI's session_id
+	Model    string
+	Workdir  string // the CLI keeps sessions per directory
+	System   string // hash of the system prompt the session was started with
+	Messages int    // how many request messages the session has seen
+	Prefix   string // hash of those messages
+	Used     time.Time
+	busy     bool // a resumed run is in flight
+}
+
+// conversations is nil when SESSION_TTL is 0
+var conversations *conversationStore
+
+func newConversationStore(ttl time.Duration) *conversationStore {
+	return &conversationStore{ttl: ttl, sessions: map[string]*cliSession{}}
+}
+
+// evict drops sessions unused for longer than the TTL and returns how many
+// it dropped. Callers hold mu.
+func (c *conversationStore) evict() int {
+	n := 0
+	for id, s := range c.sessions {
+		if !s.busy && time.Since(s.Used) > c.ttl {
+			delete(c.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// sweep evicts expired sessions for the reaper, between requests
+func (c *conversationStore) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evict()
+}
+
+// resume returns the CLI session to resume for run and how many of its
+// messages the session has already seen. The session is only reused when the
+// client's history still starts with exactly what the session saw, followed
+// by the assistant's reply and at least one new message; otherwise "" is
+// returned and the run starts afresh.
+func (c *conversationStore) resume(id string, run *claudeRun) (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+
+	s, ok := c.sessions[id]
+	msgs := run.Req.Messages
+	if !ok || s.busy || s.Model != run.Model || s.Workdir != run.workdir || s.System != hashText(run.cliSystem) ||
+		len(msgs) < s.Messages+2 || msgs[s.Messages].Role != "assistant" ||
+		hashMessages(msgs[:s.Messages]) != s.Prefix {
+		return "", 0
+	}
+	s.busy = true
+	return s.ID, s.Messages + 1
+}
+
+// save records the CLI session a run for conversation id ended up in
+func (c *conversationStore) save(id string, run *claudeRun, sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	c.sessions[id] = &cliSession{
+		ID:       sessionID,
+		Model:    run.Model,
+		Workdir:  run.workdir,
+		System:   hashText(run.cliSystem),
+		Messages: len(run.Req.Messages),
+		Prefix:   hashMessages(run.Req.Messages),
+		Used:     time.Now(),
+	}
+}
+
+// forget drops a conversation's session, so its next turn starts afresh
+func (c *conversationStore) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, id)
+}
+
+func hashText(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashMessages(msgs []Message) string {
+	data, _ := json.Marshal(msgs)
+	return hashText(string(data))
+}
+
+// useConversation ties run to the client's conversation id. If the
+// conversation has a CLI session the history can be resumed from, only the
+// messages after it are piped to the CLI.
+func (run *claudeRun) useConversation(id string) {
+	id = strings.TrimSpace(id)
+	if conversations == nil || id == "" || run.choices() > 1 {
+		return
+	}
+	run.conversation = id
+
+	sessionID, seen := conversations.resume(id, run)
+	if sessionID == "" {
+		run.log.Infof("Conversation %s: starting a new CLI session", id)
+		return
+	}
+	_, input := buildPrompts(run.Req.Messages[seen:])
+	run.log.Infof("Conversation %s: resuming CLI session %s with %d new message(s)", id, sessionID, len(run.Req.Messages)-seen)
+	run.resumeID = sessionID
+	run.fullInput = run.cliInput
+	run.cliInput = wrapUserPrompt(input)
+}
+
+// dropResume falls back to replaying the full history, for when the CLI
+// couldn't resume the session
+func (run *claudeRun) dropResume() {
+	run.log.Warnf("Conversation %s: resuming CLI session %s failed, replaying the full history", run.conversation, run.resumeID)
+	conversations.forget(run.conversation)
+	run.resumeID = ""
+	run.cliInput = run.fullInput
+}
+
+// endConversation records the session a finished run left behind, or forgets
+// the conversation's session if the run didn't complete cleanly
+func (run *claudeRun) endConversation(result claudeResult, err error) {
+	if run.conversation == "" {
+		return
+	}
+	// A stop sequence or the timeout kills the CLI mid-reply, leaving the
+	// session unusable
+	if err != nil || result.Err != nil || result.SessionID == "" || result.StopSequence != "" || result.TimedOut {
+		conversations.forget(run.conversation)
+		return
+	}
+	conversations.save(run.conversation, run, result.SessionID)
+}
+
+// handleConversation resets a conversation: DELETE /v1/conversations/{id}
+// forgets its CLI session, so the next turn replays the full history
+func handleConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authorized(r) {
+		sendError(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/conversations/")
+	if id == "" || strings.Contains(id, "/") {
+		sendError(w, "Conversation id required", http.StatusBadRequest)
+		return
+	}
+	if conversations != nil {
+		conversations.forget(id)
+	}
+	loggerFrom(r.Context()).Infof("Conversation %s: reset", id)
+	w.WriteHeader(http.StatusNoContent)
+}
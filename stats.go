@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// queueDepth counts requests waiting for a CLI slot. Past maxQueueDepth
+// (MAX_QUEUE_DEPTH, 0 for no limit) new requests are turned away at once
+// instead of joining the queue.
+var (
+	queueDepth    int64
+	maxQueueDepth int64
+)
+
+// errQueueFull means MAX_QUEUE_DEPTH requests were already waiting. It is a
+// kind of errBusy, but answered with a 503 since waiting won't help soon.
+var errQueueFull = fmt.Errorf("%w: request queue is full", errBusy)
+
+// Stats is the /stats payload
+type Stats struct {
+	Running        int   `json:"running"`         // CLI processes holding a slot
+	MaxConcurrent  int   `json:"max_concurrent"`  // MAX_CONCURRENT
+	Queued         int64 `json:"queued"`          // requests waiting for a slot
+	MaxQueueDepth  int64 `json:"max_queue_depth"` // MAX_QUEUE_DEPTH, 0 for no limit
+	ActiveRequests int64 `json:"active_requests"` // requests being served, queued or not
+	UptimeSeconds  int64 `json:"uptime_seconds"`
+}
+
+// handleStats reports how busy the proxy is, for monitoring (no auth, like
+// /health)
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Stats{
+		Running:        len(cliSlots),
+		MaxConcurrent:  cap(cliSlots),
+		Queued:         atomic.LoadInt64(&queueDepth),
+		MaxQueueDepth:  maxQueueDepth,
+		ActiveRequests: atomic.LoadInt64(&activeRequests),
+		UptimeSeconds:  int64(time.Since(startedAt).Seconds()),
+	})
+}
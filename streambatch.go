@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamBatch is how long streamed text may wait to go out with whatever
+// follows it, from STREAM_BATCH_MS; 0 sends every delta as it arrives
+var streamBatch time.Duration
+
+// textBatcher coalesces a stream's text deltas into one SSE chunk per
+// streamBatch window, saving a write and flush per token. The first text goes
+// out at once so time to first token doesn't suffer, and flush sends what is
+// left when the run ends.
+type textBatcher struct {
+	mu      sync.Mutex
+	emit    func(string)
+	pending strings.Builder
+	timer   *time.Timer
+	started bool
+}
+
+func (b *textBatcher) add(text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.started {
+		b.started = true
+		b.emit(text)
+		return
+	}
+	b.pending.WriteString(text)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(streamBatch, b.flush)
+	}
+}
+
+// flush sends any text still waiting. Calling it before anything else is
+// streamed, such as thinking, keeps the stream in order.
+func (b *textBatcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if b.pending.Len() > 0 {
+		text := b.pending.String()
+		b.pending.Reset()
+		b.emit(text)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// modelPrompts holds the per-model system prompts from SYSTEM_PROMPT_DIR,
+// by base model. They are read at startup and again on SIGHUP or a POST to
+// /admin/reload, never per request, so editing a file changes nothing until
+// then.
+var modelPrompts struct {
+	sync.RWMutex
+	dir     string
+	prompts map[string]string
+}
+
+// loadModelPrompts reads SYSTEM_PROMPT_DIR: opus.md, sonnet.md and haiku.md,
+// any of which may be missing. Other files are skipped with a warning, so a
+// misnamed one doesn't go unnoticed.
+func loadModelPrompts(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prompts := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		base := strings.TrimSuffix(name, ".md")
+		if base == name || !knownBaseModel(base) {
+			logger.Warnf("SYSTEM_PROMPT_DIR: ignoring %s, which isn't haiku.md, sonnet.md or opus.md", name)
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if prompt := strings.TrimSpace(string(data)); prompt != "" {
+			prompts[base] = prompt
+		}
+	}
+	return prompts, nil
+}
+
+func knownBaseModel(name string) bool {
+	for _, model := range modelCatalog {
+		if model.Base == name {
+			return true
+		}
+	}
+	return false
+}
+
+// initModelPrompts loads SYSTEM_PROMPT_DIR at startup
+func initModelPrompts(dir string) error {
+	prompts, err := loadModelPrompts(dir)
+	if err != nil {
+		return err
+	}
+	setModelPrompts(dir, prompts)
+	return nil
+}
+
+// watchPrompts starts reloading SYSTEM_PROMPT_DIR on SIGHUP, once
+var watchPrompts sync.Once
+
+// setModelPrompts puts prompts read from dir in place, or clears them when
+// dir is "". While a directory is set, SIGHUP reloads it; a reload that
+// fails keeps the prompts already loaded.
+func setModelPrompts(dir string, prompts map[string]string) {
+	modelPrompts.Lock()
+	modelPrompts.dir = dir
+	modelPrompts.prompts = prompts
+	modelPrompts.Unlock()
+	if dir == "" {
+		return
+	}
+	logModelPrompts("Loaded", dir, prompts)
+	watchPrompts.Do(func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reloadModelPrompts(); err != nil {
+					logger.Errorf("Reloading SYSTEM_PROMPT_DIR: %v", err)
+				}
+			}
+		}()
+	})
+}
+
+// reloadModelPrompts re-reads SYSTEM_PROMPT_DIR, if it is set
+func reloadModelPrompts() error {
+	modelPrompts.RLock()
+	dir := modelPrompts.dir
+	modelPrompts.RUnlock()
+	if dir == "" {
+		return nil
+	}
+	prompts, err := loadModelPrompts(dir)
+	if err != nil {
+		return err
+	}
+	modelPrompts.Lock()
+	modelPrompts.prompts = prompts
+	modelPrompts.Unlock()
+	logModelPrompts("Reloaded", dir, prompts)
+	return nil
+}
+
+func logModelPrompts(verb, dir string, prompts map[string]string) {
+	var loaded []string
+	for _, model := range modelCatalog {
+		if p, ok := prompts[model.Base]; ok {
+			loaded = append(loaded, fmt.Sprintf("%s (%d chars)", model.Base, len(p)))
+		}
+	}
+	if len(loaded) == 0 {
+		logger.Warnf("%s SYSTEM_PROMPT_DIR %s, but it has no model prompts", verb, dir)
+		return
+	}
+	logger.Infof("%s SYSTEM_PROMPT_DIR %s: %s", verb, dir, strings.Join(loaded, ", "))
+}
+
+// modelPrompt is the SYSTEM_PROMPT_DIR prompt for a base model, if any
+func modelPrompt(base string) string {
+	modelPrompts.RLock()
+	defer modelPrompts.RUnlock()
+	return modelPrompts.prompts[base]
+}
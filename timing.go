@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runTiming breaks down where a request's time went, for X-Proxy-Timing.
+// With n > 1 or retries, each phase is the longest any CLI run spent in it.
+type runTiming struct {
+	mu         sync.Mutex
+	queue      time.Duration // waiting for a CLI slot
+	spawn      time.Duration // starting the CLI process
+	generation time.Duration // from the CLI starting to it exiting
+	attempts   int           // CLI runs, counting retries and fallbacks
+}
+
+func (t *runTiming) queued(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queue = max(t.queue, d)
+}
+
+func (t *runTiming) spawned(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spawn = max(t.spawn, d)
+	t.attempts++
+}
+
+func (t *runTiming) generated(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.generation = max(t.generation, d)
+}
+
+// showTiming reports whether the client asked for X-Proxy-Timing, with
+// X-Proxy-Debug: true. Unlike the stderr of debugStream, it needs no DEBUG.
+func showTiming(r *http.Request) bool {
+	on, _ := strconv.ParseBool(r.Header.Get("X-Proxy-Debug"))
+	return on
+}
+
+// setTimingHeader sets X-Proxy-Timing to the run's timing breakdown as JSON,
+// in milliseconds. first_token_ms is only there for streams, and total_ms
+// runs from the request arriving to now.
+func (run *claudeRun) setTimingHeader(w http.ResponseWriter) {
+	if !run.showTiming {
+		return
+	}
+	t := &run.timing
+	t.mu.Lock()
+	breakdown := map[string]interface{}{
+		"queue_ms":      t.queue.Milliseconds(),
+		"spawn_ms":      t.spawn.Milliseconds(),
+		"generation_ms": t.generation.Milliseconds(),
+		"total_ms":      time.Since(run.started).Milliseconds(),
+		"attempts":      t.attempts,
+	}
+	t.mu.Unlock()
+	if run.timeToText > 0 {
+		breakdown["first_token_ms"] = run.timeToText.Milliseconds()
+	}
+	if run.cacheStatus == "hit" {
+		breakdown["cache"] = "hit"
+	}
+	data, _ := json.Marshal(breakdown)
+	w.Header().Set("X-Proxy-Timing", string(data))
+}
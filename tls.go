@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate from TLS_CERT_FILE/TLS_KEY_FILE and
+// picks up a rotated pair on the next handshake after the files change, so
+// renewing a certificate doesn't need a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // the later of the two files' mtimes when loaded
+}
+
+// newCertReloader loads the pair once up front, so a bad configuration
+// fails at startup rather than on the first connection
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(r.modified()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified is the most recent mtime of the certificate and key files
+func (r *certReloader) modified() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// getCertificate is the tls.Config hook. If the files changed but don't load
+// (say the cert was written before its key), the previous pair is kept and
+// the load is tried again on the next handshake.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if modTime := r.modified(); modTime.After(r.modTime) {
+		if err := r.load(modTime); err != nil {
+			logger.Warnf("Failed to reload TLS certificate, keeping the previous one: %v", err)
+		} else {
+			logger.Infof("Reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
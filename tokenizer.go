@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bpeTokenizer counts tokens the way tiktoken does: text is split into
+// pieces as cl100k_base splits it, and each piece is byte pair encoded with
+// the ranks of a .tiktoken file. Claude's own vocabulary isn't published, so
+// even exact BPE counts are only close to what the CLI reports.
+type bpeTokenizer struct {
+	ranks map[string]int // token bytes -> rank, which is also the token's ID
+}
+
+// tokenizer is loaded from TOKENIZER_FILE; without one, countTokens falls
+// back to estimateTokens
+var tokenizer *bpeTokenizer
+
+// loadTokenizer reads a .tiktoken file: one token per line, as its bytes in
+// base64 and its rank. Every single byte must have a rank, or some text
+// couldn't be encoded.
+func loadTokenizer(path string) (*bpeTokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &bpeTokenizer{ranks: map[string]int{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		encoded, rank, ok := strings.Cut(line, " ")
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if !ok || err != nil || len(token) == 0 {
+			return nil, fmt.Errorf("line %d: expected a base64 token and its rank", n)
+		}
+		if t.ranks[string(token)], err = strconv.Atoi(strings.TrimSpace(rank)); err != nil {
+			return nil, fmt.Errorf("line %d: invalid rank %q", n, rank)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for b := 0; b < 256; b++ {
+		if _, ok := t.ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("no rank for byte 0x%02x", b)
+		}
+	}
+	return t, nil
+}
+
+// countTokens counts the tokens in text with TOKENIZER_FILE's vocabulary,
+// or estimates them without one
+func countTokens(text string) int {
+	if tokenizer == nil {
+		return estimateTokens(text)
+	}
+	return tokenizer.count(text)
+}
+
+func (t *bpeTokenizer) count(text string) int {
+	n := 0
+	for _, piece := range splitPieces(text) {
+		n += len(t.merge(piece)) - 1
+	}
+	return n
+}
+
+// encode returns the token IDs of text
+func (t *bpeTokenizer) encode(text string) []int {
+	var tokens []int
+	for _, piece := range splitPieces(text) {
+		bounds := t.merge(piece)
+		for i := 0; i+1 < len(bounds); i++ {
+			tokens = append(tokens, t.ranks[piece[bounds[i]:bounds[i+1]]])
+		}
+	}
+	return tokens
+}
+
+// merge byte pair encodes one piece, as tiktoken does: starting from single
+// bytes, the adjacent pair whose join has the lowest rank is merged until no
+// join has one. It returns where each token starts, and then len(piece).
+func (t *bpeTokenizer) merge(piece string) []int {
+	if _, ok := t.ranks[piece]; ok {
+		return []int{0, len(piece)}
+	}
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, at := math.MaxInt, -1
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := t.ranks[piece[bounds[i]:bounds[i+2]]]; ok && rank < best {
+				best, at = rank, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		bounds = append(bounds[:at+1], bounds[at+2:]...)
+	}
+	return bounds
+}
+
+// maxPieceBytes bounds a piece. Merging is quadratic in a piece's length,
+// so one long run of letters sent on purpose could stall a request; cutting
+// it up only changes the count for text nobody writes.
+const maxPieceBytes = 1 << 10
+
+// splitPieces splits text the way cl100k_base's pattern does before BPE:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Go's regexp has no lookahead, so it is matched by hand, alternative by
+// alternative in the same order.
+func splitPieces(text string) []string {
+	var pieces []string
+	for i := 0; i < len(text); {
+		n := pieceLen(text[i:])
+		for n > maxPieceBytes {
+			cut := maxPieceBytes
+			for cut > maxPieceBytes-utf8.UTFMax && !utf8.RuneStart(text[i+cut]) {
+				cut--
+			}
+			pieces = append(pieces, text[i:i+cut])
+			i, n = i+cut, n-cut
+		}
+		pieces = append(pieces, text[i:i+n])
+		i += n
+	}
+	return pieces
+}
+
+// pieceLen returns the length of the piece text starts with
+func pieceLen(text string) int {
+	r, size := utf8.DecodeRuneInString(text)
+	next := func(i int) rune {
+		if i >= len(text) {
+			return -1
+		}
+		r, _ := utf8.DecodeRuneInString(text[i:])
+		return r
+	}
+	// span returns where the run of runes matching f that starts at i ends,
+	// after at most max of them if max > 0
+	span := func(i, max int, f func(rune) bool) int {
+		for n := 0; i < len(text) && (max <= 0 || n < max); n++ {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			if !f(r) {
+				break
+			}
+			i += size
+		}
+		return i
+	}
+	letter := func(r rune) bool { return unicode.IsLetter(r) }
+	number := func(r rune) bool { return unicode.IsNumber(r) }
+	other := func(r rune) bool { return r >= 0 && !unicode.IsSpace(r) && !letter(r) && !number(r) }
+	newline := func(r rune) bool { return r == '\r' || r == '\n' }
+
+	if r == '\'' {
+		rest := strings.ToLower(text[1:min(len(text), 3)])
+		for _, suffix := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if strings.HasPrefix(rest, suffix) {
+				return 1 + len(suffix)
+			}
+		}
+	}
+	if letter(r) {
+		return span(0, 0, letter)
+	}
+	if !newline(r) && !number(r) && letter(next(size)) {
+		return span(size, 0, letter)
+	}
+	if number(r) {
+		return span(0, 3, number)
+	}
+	start := 0
+	if r == ' ' {
+		start = 1
+	}
+	if other(next(start)) {
+		return span(span(start, 0, other), 0, newline)
+	}
+
+	// Whitespace: up to the last line break in the run if it has one, else
+	// all of it but the last rune before anything that follows it
+	end := span(0, 0, unicode.IsSpace)
+	if last := strings.LastIndexAny(text[:end], "\r\n"); last >= 0 {
+		return last + 1
+	}
+	if end < len(text) {
+		if _, lastSize := utf8.DecodeLastRuneInString(text[:end]); end > lastSize {
+			return end - lastSize
+		}
+	}
+	return end
+}
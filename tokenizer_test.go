@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestSplitPieces checks text is split into the pieces tiktoken's cl100k_base
+// pattern gives
+func TestSplitPieces(t *testing.T) {
+	for _, tt := range []struct {
+		text   string
+		pieces []string
+	}{
+		{"Hello, world!", []string{"Hello", ",", " world", "!"}},
+		{"I'm here", []string{"I", "'m", " here"}},
+		{"don't", []string{"don", "'t"}},
+		{"WE'LL", []string{"WE", "'LL"}},
+		{"'sup", []string{"'s", "up"}},
+		{".Hello", []string{".Hello"}},
+		{"\thello", []string{"\thello"}},
+		{"\t.", []string{"\t", "."}},
+		{"1234567", []string{"123", "456", "7"}},
+		{" 123", []string{" ", "123"}},
+		{"x = 1;\n", []string{"x", " =", " ", "1", ";\n"}},
+		{"  x", []string{" ", " x"}},
+		{"a\n\n  b", []string{"a", "\n\n", " ", " b"}},
+		{"  \n  x", []string{"  \n", " ", " x"}},
+		{"end   ", []string{"end", "   "}},
+		{"naïve café", []string{"naïve", " café"}},
+		{"日本語のテキスト", []string{"日本語のテキスト"}},
+		{"", nil},
+	} {
+		if got := splitPieces(tt.text); !slices.Equal(got, tt.pieces) {
+			t.Errorf("splitPieces(%q) = %q, want %q", tt.text, got, tt.pieces)
+		}
+	}
+}
+
+func testTokenizer(t *testing.T) *bpeTokenizer {
+	t.Helper()
+	tok, err := loadTokenizer(filepath.Join("testdata", "tokenizer", "test.tiktoken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+// TestBPE encodes text with a small vocabulary whose merges can be followed
+// by hand
+func TestBPE(t *testing.T) {
+	tok := testTokenizer(t)
+	for _, tt := range []struct {
+		text   string
+		tokens []int
+	}{
+		// hello is merged he, ll, llo, then hello; " world" gets as far as
+		// " wor" and "ld"
+		{"hello world", []int{259, 262, 263}},
+		// Nothing joins "He", so the capital H stays a byte of its own
+		{"Hello", []int{'H', 'e', 258}},
+		{"Hello, world!", []int{'H', 'e', 258, ',', 262, 263, '!'}},
+		{"hi\n", []int{'h', 'i', '\n'}},
+		{"é", []int{0xc3, 0xa9}},
+	} {
+		if got := tok.encode(tt.text); !slices.Equal(got, tt.tokens) {
+			t.Errorf("encode(%q) = %v, want %v", tt.text, got, tt.tokens)
+		}
+		if got := tok.count(tt.text); got != len(tt.tokens) {
+			t.Errorf("count(%q) = %d, want %d", tt.text, got, len(tt.tokens))
+		}
+	}
+}
+
+// TestCountTokens checks usage and max_tokens count with TOKENIZER_FILE's
+// vocabulary once it is loaded, and estimate without one
+func TestCountTokens(t *testing.T) {
+	setupProxy(t)
+	t.Cleanup(func() { tokenizer = nil })
+	const text = "hello world hello"
+	if got, want := countTokens(text), estimateTokens(text); got != want {
+		t.Errorf("without a tokenizer counted %d, want the estimate %d", got, want)
+	}
+
+	tokenizer = testTokenizer(t)
+	if got := countTokens(text); got != 5 {
+		t.Errorf("counted %d tokens, want 5", got)
+	}
+	limit := &tokenCap{max: 3}
+	if got, hit := limit.Write(text); got != "hello world" || !hit {
+		t.Errorf("max_tokens 3 let through %q (hit %v), want \"hello world\"", got, hit)
+	}
+}
+
+func TestLoadTokenizerErrors(t *testing.T) {
+	ranks, err := os.ReadFile(filepath.Join("testdata", "tokenizer", "test.tiktoken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		content string
+	}{
+		{"missing byte", string(ranks[len("AA== 0\n"):])},
+		{"bad base64", string(ranks) + "not*base64 300\n"},
+		{"bad rank", string(ranks) + "aGk= first\n"},
+		{"no rank", string(ranks) + "aGk=\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ranks.tiktoken")
+			os.WriteFile(path, []byte(tt.content), 0o644)
+			if _, err := loadTokenizer(path); err == nil {
+				t.Errorf("loaded without an error")
+			}
+		})
+	}
+}
+
+// TestLongPiece checks a huge run of letters is counted quickly, in pieces
+// of at most maxPieceBytes
+func TestLongPiece(t *testing.T) {
+	tok := testTokenizer(t)
+	text := strings.Repeat("é", 1<<20)
+	pieces := splitPieces(text)
+	if strings.Join(pieces, "") != text {
+		t.Fatalf("pieces don't add up to the text")
+	}
+	for _, piece := range pieces {
+		if len(piece) > maxPieceBytes || !utf8.ValidString(piece) {
+			t.Fatalf("piece of %d bytes, valid UTF-8 %v", len(piece), utf8.ValidString(piece))
+		}
+	}
+	if got := tok.count(text); got != 2<<20 {
+		t.Errorf("counted %d tokens, want one per byte", got)
+	}
+
+	// Not even UTF-8, so there is no rune to cut at
+	garbage := strings.Repeat("\x80", 1<<12)
+	if got := tok.count(garbage); got != len(garbage) {
+		t.Errorf("counted %d tokens in %d stray bytes", got, len(garbage))
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// OpenAI tool (function calling) structures. The CLI has no way to take
+// client-defined tools, so they are described to Claude in the system prompt
+// and its replies are parsed back into tool_calls.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is one call in a message, or in a streaming delta a piece of one:
+// the first carries the id, type and name, and later ones only their index
+// and more of the arguments.
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"` // streaming deltas only
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"` // JSON-encoded, as OpenAI sends it
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// toolCallPattern matches one call in Claude's reply. The id attribute only
+// appears when earlier calls are replayed in the transcript.
+var toolCallPattern = regexp.MustCompile(`(?s)<tool_call(?:\s+id="[^"]*")?\s+name="([^"]+)"(?:\s+id="[^"]*")?\s*>(.*?)</tool_call>`)
+
+// toolChoice is the parsed tool_choice: "auto", "none" or "required", plus
+// the function name when one specific tool is forced
+func (req ChatRequest) toolChoice() (string, string, error) {
+	raw := bytes.TrimSpace(req.ToolChoice)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "auto", "", nil
+	}
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "auto", "none", "required":
+			return mode, "", nil
+		}
+		return "", "", fmt.Errorf("tool_choice must be auto, none, required or a function")
+	}
+	var forced struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &forced); err != nil || forced.Type != "function" || forced.Function.Name == "" {
+		return "", "", fmt.Errorf("tool_choice must be auto, none, required or a function")
+	}
+	return "required", forced.Function.Name, nil
+}
+
+// usesTools reports whether Claude should be offered the client's tools
+func (req ChatRequest) usesTools() bool {
+	mode, _, _ := req.toolChoice()
+	return len(req.Tools) > 0 && mode != "none"
+}
+
+// validateTools checks the tools and tool_choice a client sent
+func validateTools(req ChatRequest) error {
+	names := map[string]bool{}
+	for i, tool := range req.Tools {
+		if tool.Type != "function" {
+			return fmt.Errorf("tools[%d]: only function tools are supported", i)
+		}
+		if !toolNamePattern.MatchString(tool.Function.Name) {
+			return fmt.Errorf("tools[%d]: function name must be 1-64 letters, digits, _ or -", i)
+		}
+		names[tool.Function.Name] = true
+	}
+	_, forced, err := req.toolChoice()
+	if err != nil {
+		return err
+	}
+	if forced != "" && !names[forced] {
+		return fmt.Errorf("tool_choice names %q, which is not in tools", forced)
+	}
+	return nil
+}
+
+// toolsPrompt describes the client's tools and how to call them, for the
+// system prompt. It is empty when no tools are on offer.
+func toolsPrompt(req ChatRequest) string {
+	if !req.usesTools() {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("You can call the following tools. Each one's arguments are described by a JSON Schema.\n\n<tools>")
+	for _, tool := range req.Tools {
+		fmt.Fprintf(&b, "\n<tool name=%q>", tool.Function.Name)
+		if tool.Function.Description != "" {
+			fmt.Fprintf(&b, "\n%s", tool.Function.Description)
+		}
+		if len(tool.Function.Parameters) > 0 {
+			fmt.Fprintf(&b, "\nParameters: %s", tool.Function.Parameters)
+		}
+		b.WriteString("\n</tool>")
+	}
+	b.WriteString("\n</tools>\n\n")
+	b.WriteString(`To call a tool, reply with one <tool_call> block per call, each holding a JSON object of arguments, and write nothing after the last block:
+
+<tool_call name="tool_name">{"argument": "value"}</tool_call>
+
+Results come back to you in <tool_result> blocks. Only call the tools listed above, never make up a tool's result, and answer normally when no tool is needed.`)
+
+	switch mode, forced, _ := req.toolChoice(); {
+	case forced != "":
+		fmt.Fprintf(&b, "\n\nYou must call the %s tool in this reply.", forced)
+	case mode == "required":
+		b.WriteString("\n\nYou must call at least one tool in this reply.")
+	}
+	return b.String()
+}
+
+// parseToolCalls pulls tool calls out of Claude's reply. It returns the text
+// before the first call and the calls with fresh ids; text without calls is
+// returned unchanged.
+func parseToolCalls(text string) (string, []ToolCall) {
+	matches := toolCallPattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, nil
+	}
+	var calls []ToolCall
+	for _, m := range matches {
+		name := text[m[2]:m[3]]
+		args := strings.TrimSpace(text[m[4]:m[5]])
+		// Arguments must be a JSON object; compact it when it is one
+		var compact bytes.Buffer
+		if json.Compact(&compact, []byte(args)) == nil && strings.HasPrefix(args, "{") {
+			args = compact.String()
+		} else if args == "" {
+			args = "{}"
+		}
+		calls = append(calls, ToolCall{
+			ID:       newToolCallID(),
+			Type:     "function",
+			Function: ToolCallFunction{Name: name, Arguments: args},
+		})
+	}
+	return strings.TrimSpace(text[:matches[0][0]]), calls
+}
+
+func newToolCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+// formatToolCalls renders an assistant's earlier tool calls for the
+// transcript, the same way Claude is asked to write them
+func formatToolCalls(calls []ToolCall) string {
+	var parts []string
+	for _, call := range calls {
+		parts = append(parts, fmt.Sprintf("<tool_call id=%q name=%q>%s</tool_call>", call.ID, call.Function.Name, call.Function.Arguments))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// formatToolResult renders a role "tool" message, or a legacy role
+// "function" one, for the transcript
+func formatToolResult(msg Message) string {
+	attr := fmt.Sprintf("tool_call_id=%q", msg.ToolCallID)
+	if msg.Role == "function" {
+		attr = fmt.Sprintf("name=%q", msg.Name)
+	}
+	return fmt.Sprintf("<tool_result %s>\n%s\n</tool_result>", attr, msg.Content.PromptText())
+}
+
+// reply turns a run's output into the assistant message and finish reason.
+// When the request offered tools, any calls Claude made are split out of the
+// text and the choice finishes with "tool_calls".
+func (run *claudeRun) reply(result claudeResult) (Message, string) {
+	msg := Message{Role: "assistant", Content: MessageContent{Text: result.Text}}
+	finishReason := openAIFinishReason(result.StopReason)
+	if run.Req.usesTools() {
+		msg.Content.Text, msg.ToolCalls = parseToolCalls(result.Text)
+		if len(msg.ToolCalls) > 0 {
+			finishReason = "tool_calls"
+			run.log.Infof("Claude made %d tool call(s)", len(msg.ToolCalls))
+		}
+	}
+	return msg, finishReason
+}
+
+// toolHeaderPattern matches the opening tag of a call, as toolCallPattern
+// does, once the whole tag has streamed in
+var toolHeaderPattern = regexp.MustCompile(`^<tool_call(?:\s+id="[^"]*")?\s+name="([^"]+)"(?:\s+id="[^"]*")?\s*>$`)
+
+// maxToolHeader is how long an opening tag may get before the text is taken
+// not to be a call after all
+const maxToolHeader = 256
+
+const (
+	toolText   = iota // in the text before, between or after calls
+	toolHeader        // in what may be a call's opening tag
+	toolArgs          // in a call's arguments
+)
+
+// toolStreamer splits a streamed reply into OpenAI deltas as it arrives, the
+// way parseToolCalls splits a whole one. Text before the first call streams
+// as content. Each call is announced with its index, a fresh id and its name
+// as soon as its opening tag is complete, and its arguments then stream as
+// fragments that add up to the JSON Claude wrote. Whatever might be the start
+// of a tag is held back until it is clear whether it is one. As with
+// parseToolCalls, text after the first call is dropped.
+type toolStreamer struct {
+	send     func(Delta)
+	state    int
+	pending  string
+	calls    int  // calls started so far
+	argsSent bool // the current call has sent some of its arguments
+}
+
+func (t *toolStreamer) Write(text string) {
+	t.pending += text
+	for {
+		switch t.state {
+		case toolText:
+			idx := strings.Index(t.pending, "<tool_call")
+			if idx < 0 {
+				keep := partialSuffix(t.pending, "<tool_call")
+				t.content(t.pending[:len(t.pending)-keep])
+				t.pending = t.pending[len(t.pending)-keep:]
+				return
+			}
+			t.content(t.pending[:idx])
+			t.pending = t.pending[idx:]
+			t.state = toolHeader
+		case toolHeader:
+			end := strings.IndexByte(t.pending, '>')
+			if end < 0 && len(t.pending) <= maxToolHeader {
+				return
+			}
+			var m []string
+			if end >= 0 {
+				m = toolHeaderPattern.FindStringSubmatch(t.pending[:end+1])
+			}
+			if m == nil {
+				// Not a call: pass the "<" on as text and look again after it
+				t.content(t.pending[:1])
+				t.pending = t.pending[1:]
+				t.state = toolText
+				continue
+			}
+			index := t.calls
+			t.send(Delta{ToolCalls: []ToolCall{{
+				Index:    &index,
+				ID:       newToolCallID(),
+				Type:     "function",
+				Function: ToolCallFunction{Name: m[1]},
+			}}})
+			t.pending = t.pending[end+1:]
+			t.state = toolArgs
+			t.argsSent = false
+		case toolArgs:
+			if !t.argsSent {
+				t.pending = strings.TrimLeftFunc(t.pending, unicode.IsSpace)
+			}
+			idx := strings.Index(t.pending, "</tool_call>")
+			if idx < 0 {
+				keep := partialSuffix(t.pending, "</tool_call>")
+				t.arguments(t.pending[:len(t.pending)-keep])
+				t.pending = t.pending[len(t.pending)-keep:]
+				return
+			}
+			t.endCall(strings.TrimRightFunc(t.pending[:idx], unicode.IsSpace))
+			t.pending = t.pending[idx+len("</tool_call>"):]
+			t.state = toolText
+		}
+	}
+}
+
+// Flush sends whatever is still held back once the stream has ended. A call
+// left open is ended with what arguments it has.
+func (t *toolStreamer) Flush() {
+	switch t.state {
+	case toolArgs:
+		t.endCall(strings.TrimSpace(t.pending))
+	default:
+		t.content(t.pending)
+	}
+	t.pending = ""
+	t.state = toolText
+}
+
+func (t *toolStreamer) content(text string) {
+	if text != "" && t.calls == 0 {
+		t.send(Delta{Content: text})
+	}
+}
+
+func (t *toolStreamer) arguments(text string) {
+	if text == "" {
+		return
+	}
+	index := t.calls
+	t.send(Delta{ToolCalls: []ToolCall{{Index: &index, Function: ToolCallFunction{Arguments: text}}}})
+	t.argsSent = true
+}
+
+// endCall sends the last of a call's arguments, or {} for a call without any
+func (t *toolStreamer) endCall(text string) {
+	if text == "" && !t.argsSent {
+		text = "{}"
+	}
+	t.arguments(text)
+	t.calls++
+}
+
+// partialSuffix is the length of the longest end of s that marker starts
+// with, which may yet turn out to be marker once more text arrives
+func partialSuffix(s, marker string) int {
+	for n := min(len(s), len(marker)-1); n > 0; n-- {
+		if strings.HasSuffix(s, marker[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// streamedToolCalls numbers calls for a streaming delta, where each entry
+// carries its position in the message's tool_calls
+func streamedToolCalls(calls []ToolCall) []ToolCall {
+	for i := range calls {
+		index := i
+		calls[i].Index = &index
+	}
+	return calls
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+const weatherTools = `[
+	{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}},
+	{"type": "function", "function": {"name": "get_time", "parameters": {"type": "object"}}}
+]`
+
+// TestStreamCLIToolUse streams recorded CLI output with tool_use blocks,
+// some named like the request's tools, and checks none of them reach the
+// client: the CLI has already run them, and only calls Claude writes out
+// are the client's to run
+func TestStreamCLIToolUse(t *testing.T) {
+	for _, tt := range []struct {
+		schema  int
+		fixture string
+	}{
+		{1, "tool_use_schema1.jsonl"},
+		{2, "tool_use_schema2.jsonl"},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			setupProxy(t)
+			cliSchema = tt.schema
+			t.Setenv("FAKE_CLAUDE_STREAM", filepath.Join("testdata", "stream", tt.fixture))
+
+			w := postJSON(handleChat, "/v1/chat/completions", `{"model": "sonnet", "stream": true, "tools": `+weatherTools+`,
+				"messages": [{"role": "user", "content": "What's the weather where I'm going?"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			var text, finish string
+			for _, chunk := range streamChunks(t, w.Body.String()) {
+				for _, choice := range chunk.Choices {
+					if choice.FinishReason != nil {
+						finish = *choice.FinishReason
+					}
+					if choice.Delta == nil {
+						continue
+					}
+					text += choice.Delta.Content
+					if len(choice.Delta.ToolCalls) > 0 {
+						t.Errorf("the CLI's own call was forwarded: %+v", choice.Delta.ToolCalls)
+					}
+				}
+			}
+			if text != "Let me check the weather." {
+				t.Errorf("text = %q", text)
+			}
+			if finish != "stop" {
+				t.Errorf("finish_reason = %q, want stop", finish)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cliUsage is the token usage the Claude CLI reports in its result message
+type cliUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// PromptTokens is every input token the model processed, cached or not
+func (u cliUsage) PromptTokens() int {
+	return u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// estimateTokens approximates how a BPE tokenizer splits text, for counting
+// without TOKENIZER_FILE. Words cost roughly one token per four letters,
+// digits are grouped in threes, punctuation is a token per symbol, and
+// non-Latin scripts are close to a token per character. It is much closer
+// than len/4 for code and non-English text, but still only an estimate.
+func estimateTokens(text string) int {
+	tokens := 0
+	letters, digits := 0, 0
+	flush := func() {
+		tokens += (letters + 3) / 4
+		tokens += (digits + 2) / 3
+		letters, digits = 0, 0
+	}
+	for _, r := range text {
+		switch {
+		case r < 128 && unicode.IsLetter(r):
+			if digits > 0 {
+				flush()
+			}
+			letters++
+		case unicode.IsDigit(r):
+			if letters > 0 {
+				flush()
+			}
+			digits++
+		case unicode.IsSpace(r):
+			// Leading spaces merge into the next word's token
+			flush()
+		case r >= 128 && unicode.IsLetter(r):
+			flush()
+			tokens++
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
+
+// tokenCap enforces max_tokens on a reply as it is produced. The CLI has no
+// option for it, so the proxy counts the output with countTokens and cuts it
+// off at the limit. A max of 0 is no limit.
+type tokenCap struct {
+	max  int
+	done int    // tokens in the text before tail
+	tail string // text since the last line break, counted afresh each time
+	hit  bool
+}
+
+// Write adds text and returns the part that fits within the limit. Once text
+// had to be cut it reports the limit as hit, and nothing more gets through.
+func (c *tokenCap) Write(text string) (string, bool) {
+	if c.max <= 0 {
+		return text, false
+	}
+	if c.hit {
+		return "", true
+	}
+	fits := func(n int) bool { return c.done+countTokens(c.tail+text[:n]) <= c.max }
+	if !fits(len(text)) {
+		n := sort.Search(len(text)+1, func(n int) bool { return !fits(n) }) - 1
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		// Rather than split a word, end at the space before it
+		if r, _ := utf8.DecodeRuneInString(text[n:]); !unicode.IsSpace(r) {
+			if space := strings.LastIndexFunc(text[:n], unicode.IsSpace); space >= 0 {
+				n = space
+			}
+		}
+		text, c.hit = text[:n], true
+	}
+	// Tokens end at line breaks, give or take a run of blank lines, so the
+	// text up to one can be counted once and set aside
+	c.tail += text
+	if i := strings.LastIndexByte(c.tail, '\n'); i >= 0 {
+		c.done += countTokens(c.tail[:i+1])
+		c.tail = c.tail[i+1:]
+	}
+	return text, c.hit
+}
+
+// usageMode is where reported token counts come from: "cli" (the CLI's own
+// numbers, estimating when it gave none), "estimate", or "off" to omit usage
+var usageMode = "cli"
+
+// runUsage returns the prompt and completion token counts for a finished run
+// and where they came from, "cli" or "estimate"
+func runUsage(run *claudeRun, result claudeResult) (int, int, string) {
+	if usageMode == "cli" && result.Usage != nil {
+		return result.Usage.PromptTokens(), result.Usage.OutputTokens, "cli"
+	}
+	return countTokens(run.SystemPrompt) + countTokens(run.UserPrompt), countTokens(result.Text), "estimate"
+}
+
+// openAIUsage builds the OpenAI usage object for a run, summed over every
+// CLI invocation when n > 1, or nil with USAGE_MODE=off. Where the numbers
+// came from goes in the X-Usage-Source header (a trailer for streams) so
+// billing never mistakes an estimate for a real count.
+func openAIUsage(w http.ResponseWriter, run *claudeRun, results ...claudeResult) *Usage {
+	if usageMode == "off" {
+		w.Header().Set("X-Usage-Source", "off")
+		return nil
+	}
+	promptTokens, completionTokens, source := 0, 0, "cli"
+	for _, result := range results {
+		p, c, src := runUsage(run, result)
+		promptTokens += p
+		completionTokens += c
+		if src != "cli" {
+			source = src
+		}
+	}
+	w.Header().Set("X-Usage-Source", source)
+	usage := &Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+	if source == "cli" {
+		usage.PromptTokensDetails = &PromptTokensDetails{}
+		for _, result := range results {
+			usage.PromptTokensDetails.CachedTokens += result.Usage.CacheReadInputTokens
+		}
+	}
+	return usage
+}
+
+// anthropicUsage is openAIUsage for the Messages API, where usage is a
+// required field: USAGE_MODE=off reports zeros instead of omitting it
+func anthropicUsage(w http.ResponseWriter, run *claudeRun, result claudeResult) AnthropicUsage {
+	if usageMode == "off" {
+		w.Header().Set("X-Usage-Source", "off")
+		return AnthropicUsage{}
+	}
+	inputTokens, outputTokens, source := runUsage(run, result)
+	w.Header().Set("X-Usage-Source", source)
+	if source == "cli" {
+		return AnthropicUsage{
+			InputTokens:              result.Usage.InputTokens,
+			OutputTokens:             outputTokens,
+			CacheCreationInputTokens: result.Usage.CacheCreationInputTokens,
+			CacheReadInputTokens:     result.Usage.CacheReadInputTokens,
+		}
+	}
+	return AnthropicUsage{InputTokens: inputTokens, OutputTokens: outputTokens}
+}